@@ -1,8 +1,6 @@
 package main
 
 import (
-	"encoding/json"
-	"io/ioutil"
 	"log"
 	"os"
 
@@ -26,14 +24,7 @@ func main() {
 			},
 		},
 		Action: func(c *cli.Context) error {
-			var config server.Config
-
-			configData, err := ioutil.ReadFile(c.Path("config"))
-			if err != nil {
-				return err
-			}
-
-			err = json.Unmarshal(configData, &config)
+			config, err := server.LoadConfig(c.Path("config"))
 			if err != nil {
 				return err
 			}
@@ -45,7 +36,7 @@ func main() {
 				config.Bind = "localhost:7788"
 			}
 
-			return server.Run(&config)
+			return server.Run(config)
 		},
 	}
 
@@ -0,0 +1,224 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/alioygur/gores"
+)
+
+type authRole int
+
+const (
+	roleNone authRole = iota
+	roleViewer
+	roleGCI
+	roleAdmin
+)
+
+var authRoleNames = map[string]authRole{
+	"viewer": roleViewer,
+	"gci":    roleGCI,
+	"admin":  roleAdmin,
+}
+
+// Server name used in role and public server lists to match every server
+const authAnyServer = "*"
+
+type authUser struct {
+	name       string
+	tokens     []string
+	discordIds []string
+	roles      map[string]authRole
+	coalitions map[string]string
+}
+
+// Resolves API tokens to users and their per-server roles
+type authenticator struct {
+	users  []*authUser
+	public map[string]bool
+}
+
+func newAuthenticator(config *AuthConfig) (*authenticator, error) {
+	auth := &authenticator{public: make(map[string]bool)}
+	for _, serverName := range config.PublicServers {
+		auth.public[serverName] = true
+	}
+
+	for _, userConfig := range config.Users {
+		user := &authUser{
+			name:       userConfig.Name,
+			tokens:     userConfig.Tokens,
+			discordIds: userConfig.DiscordIds,
+			roles:      make(map[string]authRole, len(userConfig.Roles)),
+			coalitions: make(map[string]string, len(userConfig.Coalitions)),
+		}
+
+		for serverName, roleName := range userConfig.Roles {
+			role, ok := authRoleNames[roleName]
+			if !ok {
+				return nil, fmt.Errorf("user %v has an invalid role '%v' for server %v", userConfig.Name, roleName, serverName)
+			}
+			user.roles[serverName] = role
+		}
+
+		for serverName, coalitionName := range userConfig.Coalitions {
+			coalition, err := parseCoalition(coalitionName)
+			if err != nil || coalition == "" {
+				return nil, fmt.Errorf("user %v has an invalid coalition '%v' for server %v", userConfig.Name, coalitionName, serverName)
+			}
+			user.coalitions[serverName] = coalition
+		}
+		auth.users = append(auth.users, user)
+	}
+
+	return auth, nil
+}
+
+// Returns the user owning a token, or nil if no user does
+func (a *authenticator) findUser(token string) *authUser {
+	var result *authUser
+	for _, user := range a.users {
+		for _, userToken := range user.tokens {
+			if subtle.ConstantTimeCompare([]byte(token), []byte(userToken)) == 1 {
+				result = user
+			}
+		}
+	}
+	return result
+}
+
+// Returns the user a Discord account logged into the web UI acts as, or nil
+func (a *authenticator) findDiscordUser(discordId string) *authUser {
+	for _, user := range a.users {
+		for _, id := range user.discordIds {
+			if id == discordId {
+				return user
+			}
+		}
+	}
+	return nil
+}
+
+// Returns the role a user (nil when unauthenticated) has on a server
+func (a *authenticator) role(user *authUser, serverName string) authRole {
+	role := roleNone
+	if a.public[serverName] || a.public[authAnyServer] {
+		role = roleViewer
+	}
+
+	if user != nil {
+		for _, name := range []string{serverName, authAnyServer} {
+			if userRole, ok := user.roles[name]; ok && userRole > role {
+				role = userRole
+			}
+		}
+	}
+	return role
+}
+
+// Returns the coalition a user (nil when unauthenticated) is assigned on a
+// server, or an empty string if they have none
+func (a *authenticator) coalition(user *authUser, serverName string) string {
+	if user == nil {
+		return ""
+	}
+
+	if coalition, ok := user.coalitions[serverName]; ok {
+		return coalition
+	}
+	return user.coalitions[authAnyServer]
+}
+
+type authContextKey struct{}
+
+// Returns the token passed with a request, either as a bearer token or through
+// the token query parameter for clients (e.g. EventSource) which can't set headers
+func getRequestToken(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	if strings.HasPrefix(header, "Bearer ") {
+		return strings.TrimPrefix(header, "Bearer ")
+	}
+	return r.URL.Query().Get("token")
+}
+
+// Hides the token query parameter from the request URI, which is what the request
+// logger prints. Handlers read the token from the parsed URL which is unchanged.
+func redactRequestToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if query.Get("token") != "" {
+			query.Set("token", "REDACTED")
+			r = r.WithContext(r.Context())
+			r.RequestURI = r.URL.EscapedPath() + "?" + query.Encode()
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Attaches the authenticated user to requests, rejecting requests with an unknown
+// token. Requests without a token use the Discord account logged into the web UI.
+func (a *authenticator) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := getRequestToken(r)
+		if token == "" {
+			if webUser := getWebUser(r); webUser != nil {
+				if user := a.findDiscordUser(webUser.Id); user != nil {
+					r = r.WithContext(context.WithValue(r.Context(), authContextKey{}, user))
+				}
+			}
+
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		user := a.findUser(token)
+		if user == nil {
+			gores.Error(w, 401, "invalid token")
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), authContextKey{}, user)))
+	})
+}
+
+// Returns the role of the requesting user on a server, every request has full
+// access when authentication is not configured
+func (h *httpServer) getRole(r *http.Request, serverName string) authRole {
+	if h.auth == nil {
+		return roleAdmin
+	}
+
+	user, _ := r.Context().Value(authContextKey{}).(*authUser)
+	return h.auth.role(user, serverName)
+}
+
+// Returns the coalition assigned to the requesting user on a server, or an empty
+// string if they have none
+func (h *httpServer) getCoalition(r *http.Request, serverName string) string {
+	if h.auth == nil {
+		return ""
+	}
+
+	user, _ := r.Context().Value(authContextKey{}).(*authUser)
+	return h.auth.coalition(user, serverName)
+}
+
+// Checks the requesting user has at least the given role on a server, writing an
+// error response and returning false if they do not
+func (h *httpServer) ensureRole(w http.ResponseWriter, r *http.Request, serverName string, role authRole) bool {
+	if h.getRole(r, serverName) >= role {
+		return true
+	}
+
+	if r.Context().Value(authContextKey{}) == nil {
+		gores.Error(w, 401, "authentication required")
+	} else {
+		gores.Error(w, 403, "forbidden")
+	}
+	return false
+}
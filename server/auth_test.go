@@ -0,0 +1,95 @@
+package server
+
+import "testing"
+
+func newTestAuthenticator(t *testing.T, publicServers ...string) *authenticator {
+	t.Helper()
+	auth, err := newAuthenticator(&AuthConfig{
+		PublicServers: publicServers,
+		Users: []AuthUserConfig{
+			{
+				Name:   "alice",
+				Tokens: []string{"alice-token"},
+				Roles:  map[string]string{"*": "viewer", "saw": "admin"},
+			},
+			{
+				Name:   "bob",
+				Tokens: []string{"bob-token"},
+				Roles:  map[string]string{"*": "gci", "saw": "viewer"},
+				Coalitions: map[string]string{
+					"*":   "red",
+					"saw": "Blue",
+				},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to create authenticator: %v", err)
+	}
+	return auth
+}
+
+func TestAuthenticatorRole(t *testing.T) {
+	cases := []struct {
+		name     string
+		public   []string
+		token    string
+		server   string
+		expected authRole
+	}{
+		{"anonymous", nil, "", "saw", roleNone},
+		{"anonymous on a public server", []string{"saw"}, "", "saw", roleViewer},
+		{"anonymous on another server", []string{"saw"}, "", "other", roleNone},
+		{"anonymous with every server public", []string{"*"}, "", "other", roleViewer},
+		{"unknown token", nil, "wrong", "saw", roleNone},
+		{"server role above the wildcard", nil, "alice-token", "saw", roleAdmin},
+		{"wildcard role", nil, "alice-token", "other", roleViewer},
+		{"wildcard role above the server role", nil, "bob-token", "saw", roleGCI},
+		{"user role above public", []string{"*"}, "bob-token", "other", roleGCI},
+	}
+
+	for _, c := range cases {
+		auth := newTestAuthenticator(t, c.public...)
+		var user *authUser
+		if c.token != "" {
+			user = auth.findUser(c.token)
+		}
+
+		if role := auth.role(user, c.server); role != c.expected {
+			t.Errorf("%s: expected role %v, got %v", c.name, c.expected, role)
+		}
+	}
+}
+
+func TestAuthenticatorCoalition(t *testing.T) {
+	auth := newTestAuthenticator(t)
+	cases := []struct {
+		token    string
+		server   string
+		expected string
+	}{
+		{"", "saw", ""},
+		{"alice-token", "saw", ""},
+		{"bob-token", "saw", coalitionBlue},
+		{"bob-token", "other", coalitionRed},
+	}
+
+	for _, c := range cases {
+		if coalition := auth.coalition(auth.findUser(c.token), c.server); coalition != c.expected {
+			t.Errorf("%q on %v: expected coalition %q, got %q", c.token, c.server, c.expected, coalition)
+		}
+	}
+}
+
+func TestNewAuthenticatorRejectsInvalidConfig(t *testing.T) {
+	users := []AuthUserConfig{
+		{Name: "role", Roles: map[string]string{"saw": "owner"}},
+		{Name: "coalition", Coalitions: map[string]string{"saw": "green"}},
+	}
+
+	for _, user := range users {
+		if _, err := newAuthenticator(&AuthConfig{Users: []AuthUserConfig{user}}); err == nil {
+			t.Errorf("expected an error for the invalid %v", user.Name)
+		}
+	}
+}
@@ -0,0 +1,266 @@
+package server
+
+import (
+	"errors"
+	"strings"
+)
+
+const (
+	coalitionBlue = "blue"
+	coalitionRed  = "red"
+)
+
+// Coalitions which subscribers may select as their view of a session
+var viewCoalitions = []string{coalitionBlue, coalitionRed}
+
+// Default range (in nautical miles) at which a coalition's units detect others
+const defaultDetectionRange = 100.0
+
+var errInvalidCoalition = errors.New("invalid coalition")
+
+// Parses a user-provided coalition name, an empty value selects the unfiltered view
+func parseCoalition(value string) (string, error) {
+	value = strings.ToLower(value)
+	if value == "" {
+		return "", nil
+	}
+
+	for _, coalition := range viewCoalitions {
+		if value == coalition {
+			return coalition, nil
+		}
+	}
+	return "", errInvalidCoalition
+}
+
+// Returns the coalition an object belongs to, or an empty string for neutral objects
+func getObjectCoalition(object *StateObject) string {
+	color := strings.ToLower(object.Properties["Color"])
+	for _, coalition := range viewCoalitions {
+		if color == coalition {
+			return coalition
+		}
+	}
+	return ""
+}
+
+// Returns whether an object is able to detect other objects for its coalition
+func isSensorObject(object *StateObject) bool {
+	if object.HasType("Weapon") || object.HasType("Static") {
+		return false
+	}
+	return object.HasType("Air") || object.HasType("Ground") || object.HasType("Sea")
+}
+
+// Returns whether an object is a coalition's bullseye, which only that coalition
+// may ever see
+func isBullseye(object *StateObject) bool {
+	return object.HasType("Bullseye")
+}
+
+// Returns whether an object is a ground unit subject to the ground unit modes
+func isGroundUnit(object *StateObject) bool {
+	return object.HasType("Ground") && !object.HasType("Air") && !object.HasType("Static")
+}
+
+// Tracks which objects are visible to a given coalition, an empty coalition
+// represents the unfiltered view which can see every object.
+type coalitionView struct {
+	server    *TacViewServerConfig
+	terrain   *terrainData
+	coalition string
+	visible   map[uint64]bool
+
+	// Sees every object regardless of the ground unit modes, used to record the
+	// state for rewinding
+	recording bool
+}
+
+func newCoalitionView(server *TacViewServerConfig, terrain *terrainData, coalition string) *coalitionView {
+	return &coalitionView{server: server, terrain: terrain, coalition: coalition, visible: make(map[uint64]bool)}
+}
+
+// Returns a view of every object, which the coalition views can be rebuilt from
+func newRecordingView(server *TacViewServerConfig) *coalitionView {
+	view := newCoalitionView(server, nil, "")
+	view.recording = true
+	return view
+}
+
+func (v *coalitionView) detectionRange() float64 {
+	if v.server.DetectionRange != 0 {
+		return v.server.DetectionRange
+	}
+	return defaultDetectionRange
+}
+
+// Returns whether the ground unit modes allow this view to see a ground unit.
+// The unfiltered view matches the web UI which presents blue as friendly.
+func (v *coalitionView) allowsGroundUnit(object *StateObject) bool {
+	viewCoalition := v.coalition
+	if viewCoalition == "" {
+		viewCoalition = coalitionBlue
+	}
+
+	if getObjectCoalition(object) == viewCoalition {
+		return v.server.EnableFriendlyGroundUnits
+	}
+	return v.server.EnableEnemyGroundUnits
+}
+
+// Returns the set of objects currently visible to this view, assumes you have a
+// lock on the state the objects belong to
+func (v *coalitionView) detect(objects map[uint64]*StateObject) map[uint64]bool {
+	visible := make(map[uint64]bool, len(objects))
+	if v.recording {
+		for id, object := range objects {
+			if !object.Deleted {
+				visible[id] = true
+			}
+		}
+		return visible
+	}
+
+	sensors := []*StateObject{}
+
+	for id, object := range objects {
+		if object.Deleted {
+			continue
+		}
+
+		objectCoalition := getObjectCoalition(object)
+		if v.coalition == "" || objectCoalition == "" || objectCoalition == v.coalition {
+			visible[id] = true
+
+			if v.coalition != "" && objectCoalition == v.coalition && isSensorObject(object) {
+				sensors = append(sensors, object)
+			}
+		}
+	}
+
+	if v.coalition != "" {
+		useRadar := radarEnabled(v.server)
+		var radars []*radarSite
+		if useRadar {
+			radars = getRadarSites(v.server, v.terrain, v.coalition, objects)
+		}
+
+		rangeMeters := v.detectionRange() * metersPerNauticalMile
+		for id, object := range objects {
+			if object.Deleted || visible[id] || isBullseye(object) {
+				continue
+			}
+
+			// When radars are enabled they are the only way to detect airborne
+			// and surface tracks, everything else is still spotted by proximity.
+			if useRadar && isRadarTrackable(object) {
+				for _, radar := range radars {
+					if radar.detects(object, v.terrain) {
+						visible[id] = true
+						break
+					}
+				}
+				continue
+			}
+
+			for _, sensor := range sensors {
+				if haversineDistance(sensor.Latitude, sensor.Longitude, object.Latitude, object.Longitude) <= rangeMeters {
+					visible[id] = true
+					break
+				}
+			}
+		}
+	}
+
+	for id := range visible {
+		if isGroundUnit(objects[id]) && !v.allowsGroundUnit(objects[id]) {
+			delete(visible, id)
+		}
+	}
+
+	return visible
+}
+
+// Returns whether this view may see the track history of an object. Opposing
+// objects are excluded as their history may predate being detected.
+func (v *coalitionView) canSeeHistory(object *StateObject) bool {
+	if v.coalition == "" {
+		return true
+	}
+
+	objectCoalition := getObjectCoalition(object)
+	return objectCoalition == "" || objectCoalition == v.coalition
+}
+
+// Returns the objects with their track history attached where this view may see
+// it, assumes you have a lock on the state the objects belong to
+func (v *coalitionView) attachHistory(objects []*StateObject) []*StateObject {
+	result := make([]*StateObject, len(objects))
+	for idx, object := range objects {
+		if v.canSeeHistory(object) {
+			result[idx] = object.withHistory()
+		} else {
+			result[idx] = object
+		}
+	}
+	return result
+}
+
+// Recomputes the visible set and returns the currently visible objects
+func (v *coalitionView) reset(objects map[uint64]*StateObject) []*StateObject {
+	v.visible = v.detect(objects)
+	return v.objects(objects)
+}
+
+// Returns the objects which were visible as of the last detection pass
+func (v *coalitionView) objects(objects map[uint64]*StateObject) []*StateObject {
+	result := make([]*StateObject, 0, len(v.visible))
+	for id := range v.visible {
+		object, ok := objects[id]
+		if !ok || object.Deleted {
+			continue
+		}
+		result = append(result, object)
+	}
+	return result
+}
+
+// Builds a radar snapshot containing the changes visible to this view since the
+// given offset. Objects entering or leaving the view are reported as created
+// or deleted respectively.
+func (v *coalitionView) snapshot(objects map[uint64]*StateObject, offset int64, since int64) *sessionRadarSnapshotData {
+	visible := v.detect(objects)
+
+	data := &sessionRadarSnapshotData{
+		Offset:  offset,
+		Created: make([]*StateObject, 0),
+		Updated: make([]*StateObject, 0),
+		Deleted: make([]uint64, 0),
+	}
+
+	for id, object := range objects {
+		wasVisible := v.visible[id]
+		if !visible[id] {
+			if wasVisible {
+				data.Deleted = append(data.Deleted, id)
+			}
+			continue
+		}
+
+		if !wasVisible {
+			data.Created = append(data.Created, object)
+		} else if object.UpdatedAt > since {
+			data.Updated = append(data.Updated, object)
+		}
+	}
+
+	// Objects which have been removed from the state entirely are deleted too
+	for id := range v.visible {
+		if _, ok := objects[id]; !ok {
+			data.Deleted = append(data.Deleted, id)
+		}
+	}
+
+	v.visible = visible
+	return data
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func coalitionTestObject(id uint64, color string, types []string, latitude float64, longitude float64) *StateObject {
+	return &StateObject{
+		Id:         id,
+		Types:      types,
+		Properties: map[string]string{"Color": color},
+		Latitude:   latitude,
+		Longitude:  longitude,
+	}
+}
+
+// A degree of latitude is 60 nautical miles, within the default detection range
+// of 100 nautical miles
+func coalitionTestObjects() map[uint64]*StateObject {
+	deleted := coalitionTestObject(9, "Blue", []string{"Air", "FixedWing"}, 34, 35)
+	deleted.Deleted = true
+
+	return map[uint64]*StateObject{
+		1: coalitionTestObject(1, "Blue", []string{"Air", "FixedWing"}, 34, 35),
+		2: coalitionTestObject(2, "Red", []string{"Air", "FixedWing"}, 34.5, 35),
+		3: coalitionTestObject(3, "Red", []string{"Air", "FixedWing"}, 37, 35),
+		4: coalitionTestObject(4, "Red", []string{"Navaid", "Static", "Bullseye"}, 34, 35.1),
+		5: coalitionTestObject(5, "Blue", []string{"Navaid", "Static", "Bullseye"}, 40, 40),
+		6: coalitionTestObject(6, "Neutral", []string{"Ground", "Static", "Building"}, 40, 40),
+		7: coalitionTestObject(7, "Red", []string{"Ground", "AntiAircraft"}, 34.1, 35),
+		8: coalitionTestObject(8, "Blue", []string{"Ground", "Tank"}, 45, 45),
+		9: deleted,
+	}
+}
+
+func TestCoalitionViewDetect(t *testing.T) {
+	cases := []struct {
+		name        string
+		coalition   string
+		groundUnits bool
+		expected    []uint64
+	}{
+		// Enemies out of range and enemy bullseyes are hidden, even when a friendly
+		// unit is close by
+		{"blue", coalitionBlue, true, []uint64{1, 2, 5, 6, 7, 8}},
+		{"red", coalitionRed, true, []uint64{1, 2, 3, 4, 6, 7}},
+		{"blue without ground units", coalitionBlue, false, []uint64{1, 2, 5, 6}},
+		{"unfiltered", "", true, []uint64{1, 2, 3, 4, 5, 6, 7, 8}},
+		{"unfiltered without ground units", "", false, []uint64{1, 2, 3, 4, 5, 6}},
+	}
+
+	for _, c := range cases {
+		server := &TacViewServerConfig{
+			EnableFriendlyGroundUnits: c.groundUnits,
+			EnableEnemyGroundUnits:    c.groundUnits,
+		}
+		visible := newCoalitionView(server, nil, c.coalition).detect(coalitionTestObjects())
+
+		ids := []uint64{}
+		for id := range visible {
+			ids = append(ids, id)
+		}
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+		if !reflect.DeepEqual(ids, c.expected) {
+			t.Errorf("%s: expected %v to be visible, got %v", c.name, c.expected, ids)
+		}
+	}
+}
+
+func TestCoalitionViewDetectionRange(t *testing.T) {
+	server := &TacViewServerConfig{DetectionRange: 20}
+	visible := newCoalitionView(server, nil, coalitionBlue).detect(coalitionTestObjects())
+	if visible[2] {
+		t.Errorf("expected an enemy 30nm away to be hidden with a 20nm detection range")
+	}
+
+	// Recording views see everything regardless of the ground unit modes
+	visible = newRecordingView(server).detect(coalitionTestObjects())
+	if len(visible) != 8 || visible[9] {
+		t.Errorf("expected every object but the deleted one to be recorded, got %v", visible)
+	}
+}
+
+func TestCoalitionViewSnapshot(t *testing.T) {
+	objects := coalitionTestObjects()
+	view := newCoalitionView(&TacViewServerConfig{}, nil, coalitionBlue)
+	view.reset(objects)
+
+	// The enemy flies out of range while another comes into range
+	objects[2].Latitude = 37
+	objects[2].UpdatedAt = 10
+	objects[3].Latitude = 34.5
+	objects[3].UpdatedAt = 10
+	objects[1].Longitude = 35.1
+	objects[1].UpdatedAt = 10
+
+	data := view.snapshot(objects, 10, 5)
+	if len(data.Created) != 1 || data.Created[0].Id != 3 {
+		t.Errorf("expected object 3 to be created, got %v", data.Created)
+	}
+	if len(data.Updated) != 1 || data.Updated[0].Id != 1 {
+		t.Errorf("expected object 1 to be updated, got %v", data.Updated)
+	}
+	if !reflect.DeepEqual(data.Deleted, []uint64{2}) {
+		t.Errorf("expected object 2 to be deleted, got %v", data.Deleted)
+	}
+}
@@ -1,10 +1,104 @@
 package server
 
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"time"
+)
+
 type Config struct {
 	Bind       string                    `json:"bind"`
 	Servers    []TacViewServerConfig     `json:"servers"`
 	AssetsPath *string                   `json:"assets_path"`
 	Discord    *DiscordIntegrationConfig `json:"discord"`
+	Auth       *AuthConfig               `json:"auth"`
+	GCI        *GCIConfig                `json:"gci"`
+
+	// Origins (e.g. https://sneaker.example.com) of other sites allowed to open
+	// websockets, the web UIs own origin is always allowed
+	AllowedOrigins []string `json:"allowed_origins"`
+
+	// The file this config was loaded from, used when reloading
+	path string
+}
+
+// Reads a configuration file
+func LoadConfig(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var config Config
+	err = json.Unmarshal(data, &config)
+	if err != nil {
+		return nil, err
+	}
+
+	err = config.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	config.path = path
+	return &config, nil
+}
+
+// Checks for settings which can't work together
+func (c *Config) validate() error {
+	for _, server := range c.Servers {
+		// Coalition views are tied to users, without them anyone could pick
+		// the opposing coalitions view
+		if server.EnableFogOfWar && c.Auth == nil {
+			return fmt.Errorf("server %v enables fog of war, which requires an auth section assigning users a coalition", server.Name)
+		}
+
+		// Reads timing out first would disconnect paused missions before the
+		// stall watchdog marks them stale
+		staleTimeout, stallTimeout := getStallTimeouts(&server)
+		if server.ReadTimeout > 0 && getReadTimeout(&server) < staleTimeout+stallTimeout+readTimeoutMargin*time.Second {
+			return fmt.Errorf("server %v has a read_timeout of %vs, which must be at least %vs longer than stale_timeout + stall_timeout (%v)",
+				server.Name, server.ReadTimeout, readTimeoutMargin, staleTimeout+stallTimeout)
+		}
+
+		for _, site := range server.RadarSites {
+			if err := validateRadarSite(&site); err != nil {
+				return fmt.Errorf("server %v has an invalid radar site %v: %v", server.Name, site.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+type GCIConfig struct {
+	StatePath *string `json:"state_path"`
+
+	// Minutes before a GCI is taken off duty, and before that to remind them
+	Timeout  *int `json:"timeout"`
+	Reminder *int `json:"reminder"`
+}
+
+type AuthConfig struct {
+	Users []AuthUserConfig `json:"users"`
+
+	// Servers which can be viewed without a token, "*" matches every server
+	PublicServers []string `json:"public_servers"`
+}
+
+type AuthUserConfig struct {
+	Name   string   `json:"name"`
+	Tokens []string `json:"tokens"`
+
+	// Discord users logged into the web UI which act as this user
+	DiscordIds []string `json:"discord_ids"`
+
+	// Role (viewer, gci or admin) by server name, "*" matches every server
+	Roles map[string]string `json:"roles"`
+
+	// Coalition (blue or red) by server name whose view the user receives on
+	// servers with fog of war, "*" matches every server
+	Coalitions map[string]string `json:"coalitions"`
 }
 
 type DiscordIntegrationConfig struct {
@@ -14,6 +108,18 @@ type DiscordIntegrationConfig struct {
 	StatePath      *string `json:"state_path"`
 	Timeout        *int    `json:"timeout"`
 	Reminder       *int    `json:"reminder"`
+
+	// OAuth2 settings used to log into the web UI with Discord
+	ClientSecret string `json:"client_secret"`
+	RedirectURL  string `json:"redirect_url"`
+
+	// Key used to sign session cookies, a random key is generated on startup
+	// (logging everyone out on restart) when unset
+	SessionSecret *string `json:"session_secret"`
+
+	// Whether cookies are only sent over HTTPS, defaults to whether the redirect
+	// URL uses HTTPS
+	SecureCookies *bool `json:"secure_cookies"`
 }
 
 type TacViewServerConfig struct {
@@ -26,4 +132,91 @@ type TacViewServerConfig struct {
 
 	EnableFriendlyGroundUnits bool `json:"enable_friendly_ground_units"`
 	EnableEnemyGroundUnits    bool `json:"enable_enemy_ground_units"`
+
+	EnableFogOfWar bool    `json:"enable_fog_of_war"`
+	DetectionRange float64 `json:"detection_range"`
+
+	RadarSites       []RadarSiteConfig `json:"radar_sites"`
+	EnableUnitRadars bool              `json:"enable_unit_radars"`
+	TerrainPath      *string           `json:"terrain_path"`
+
+	RecordingPath      *string `json:"recording_path"`
+	CompressRecordings bool    `json:"compress_recordings"`
+
+	Replay *ReplayConfig `json:"replay"`
+
+	RewindDuration int64 `json:"rewind_duration"`
+
+	TrackHistoryLength int  `json:"track_history_length"`
+	SendTrackHistory   bool `json:"send_track_history"`
+
+	// Origin of the simulated antenna for subscribers using sweep mode
+	SweepOrigin *SweepOriginConfig `json:"sweep_origin"`
+
+	// Number of subscribers with their own refresh rate or sweep accepted at once
+	MaxScopedSubscribers int `json:"max_scoped_subscribers"`
+
+	// Other Tacview servers (such as a relay) to fail over to when the current
+	// one can't be reached
+	AlternateEndpoints []TacViewEndpointConfig `json:"alternate_endpoints"`
+
+	// Timeouts (in seconds) for connecting to Tacview and for each read once connected
+	ConnectTimeout int64 `json:"connect_timeout"`
+	ReadTimeout    int64 `json:"read_timeout"`
+
+	// Seconds without time frames before the session is marked stale, and how
+	// many more before it is reconnected
+	StaleTimeout int64 `json:"stale_timeout"`
+	StallTimeout int64 `json:"stall_timeout"`
+
+	Reconnect *ReconnectConfig `json:"reconnect"`
+}
+
+type TacViewEndpointConfig struct {
+	Hostname string `json:"hostname"`
+	Port     int    `json:"port"`
+}
+
+// Exponential backoff between attempts to reconnect to Tacview, delays are in seconds
+type ReconnectConfig struct {
+	MinDelay   float64 `json:"min_delay"`
+	MaxDelay   float64 `json:"max_delay"`
+	Multiplier float64 `json:"multiplier"`
+
+	// Fraction of the delay it is randomly varied by
+	Jitter *float64 `json:"jitter"`
+}
+
+type SweepOriginConfig struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+type ReplayConfig struct {
+	Path string `json:"path"`
+
+	// Playback speed multiplier, defaults to realtime
+	Speed float64 `json:"speed"`
+	Loop  bool    `json:"loop"`
+
+	// Offset (in seconds) into the recording to begin playback from
+	StartOffset float64 `json:"start_offset"`
+}
+
+type RadarSiteConfig struct {
+	Name      string  `json:"name"`
+	Coalition string  `json:"coalition"`
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+
+	// Elevation of the site and height of the antenna above it, in meters. When
+	// left unset the elevation is read from the servers terrain data.
+	Elevation     float64 `json:"elevation"`
+	AntennaHeight float64 `json:"antenna_height"`
+
+	// Detection range in nautical miles, required
+	Range float64 `json:"range"`
+
+	// Minimum altitude (MSL, in meters) a target must be at to be detected
+	MinAltitude float64 `json:"min_altitude"`
 }
@@ -5,36 +5,25 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"net/http"
-	"os"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/alioygur/gores"
 	"github.com/bwmarrin/discordgo"
 )
 
-type gciState struct {
-	DiscordId       string
-	Server          string
-	Notes           string
-	ExpiresAt       time.Time
-	Warned          bool
-	DirectMessageId string
-}
-
 type DiscordIntegration struct {
-	sync.RWMutex
-
 	config  *DiscordIntegrationConfig
 	key     ed25519.PublicKey
 	session *discordgo.Session
 	http    *httpServer
 
-	gcis map[string]*gciState
+	// Key used to sign web UI session cookies
+	sessionSecret []byte
+
+	metrics discordMetrics
 }
 
 func NewDiscordIntegration(http *httpServer, config *DiscordIntegrationConfig) *DiscordIntegration {
@@ -50,22 +39,13 @@ func NewDiscordIntegration(http *httpServer, config *DiscordIntegrationConfig) *
 
 	key := ed25519.PublicKey(keyBytes)
 
-	if config.Timeout == nil {
-		timeout := 60
-		config.Timeout = &timeout
-	}
-
-	if config.Reminder == nil {
-		reminder := 5
-		config.Reminder = &reminder
-	}
-
 	return &DiscordIntegration{
 		key:     key,
 		config:  config,
 		session: session,
 		http:    http,
-		gcis:    make(map[string]*gciState),
+
+		sessionSecret: getSessionSecret(config),
 	}
 }
 
@@ -78,6 +58,81 @@ func respondWithMessage(w http.ResponseWriter, content string) {
 	})
 }
 
+// Returns the user which triggered an interaction
+func getInteractionUser(interaction *discordgo.Interaction) *discordgo.User {
+	if interaction.Member != nil {
+		return interaction.Member.User
+	}
+	return interaction.User
+}
+
+// Marks a Discord user on-duty as a GCI for a server, opening a direct message
+// channel used to remind them before their duty expires
+func (d *DiscordIntegration) sunrise(userId string, name string, server string, notes string) (*gciState, error) {
+	if gci := d.http.gcis.get(userId); gci != nil {
+		return gci, errGCIAlreadyActive
+	}
+
+	var directMessageId string
+	dm, err := d.session.UserChannelCreate(userId)
+	if err == nil && dm != nil {
+		directMessageId = dm.ID
+	}
+
+	return d.http.gcis.sunrise(gciState{
+		Id:              userId,
+		Name:            name,
+		DiscordId:       userId,
+		Server:          server,
+		Notes:           notes,
+		DirectMessageId: directMessageId,
+	})
+}
+
+func (d *DiscordIntegration) gciExpired(gci gciState) {
+	if gci.DirectMessageId == "" {
+		return
+	}
+
+	_, err := d.session.ChannelMessageSend(
+		gci.DirectMessageId, "Your GCI session has expired. Please re-sunrise if you are not done yet.",
+	)
+	if err != nil {
+		log.Printf("warning: failed to send GCI expiry warning: %v", err)
+	}
+}
+
+func (d *DiscordIntegration) gciExpiring(gci gciState, remaining time.Duration) {
+	if gci.DirectMessageId == "" {
+		return
+	}
+
+	data := &discordgo.MessageSend{
+		Content: fmt.Sprintf(
+			"Your GCI session expires in %d minutes! Please /gci refresh if you are not done yet.",
+			int(remaining.Minutes()),
+		),
+		Components: []discordgo.MessageComponent{
+			&discordgo.ActionsRow{
+				Components: []discordgo.MessageComponent{
+					&discordgo.Button{
+						Label:    "Refresh",
+						CustomID: "refresh-gci",
+						Style:    discordgo.SuccessButton,
+					},
+				},
+			},
+		},
+	}
+	_, err := d.session.ChannelMessageSendComplex(
+		gci.DirectMessageId,
+		data,
+	)
+	if err != nil {
+		log.Printf("warning: failed to send GCI expiry warning: %v", err)
+	}
+}
+
 func (d *DiscordIntegration) commandGCISunrise(w http.ResponseWriter, interaction *discordgo.Interaction, options []*discordgo.ApplicationCommandInteractionDataOption, userId string) {
 	server := options[0].Value.(string)
 	var notes string
@@ -85,40 +140,25 @@ func (d *DiscordIntegration) commandGCISunrise(w http.ResponseWriter, interactio
 		notes = options[1].Value.(string)
 	}
 
-	d.RLock()
-	state, exists := d.gcis[userId]
-	d.RUnlock()
-	if exists {
-		respondWithMessage(w, fmt.Sprintf("You are already registered as an active GCI on %s", state.Server))
-		return
+	var name string
+	if user := getInteractionUser(interaction); user != nil {
+		name = user.Username
 	}
 
-	d.http.Lock()
-	_, exists = d.http.sessions[server]
-	d.http.Unlock()
-	if !exists {
+	state, err := d.sunrise(userId, name, server, notes)
+	if err == errGCIAlreadyActive {
+		respondWithMessage(w, fmt.Sprintf("You are already registered as an active GCI on %s", state.Server))
+		return
+	} else if err != nil {
 		respondWithMessage(w, fmt.Sprintf("No server named '%s'.", server))
 		return
 	}
 
-	dm, _ := d.session.UserChannelCreate(userId)
-
-	d.Lock()
-	d.gcis[userId] = &gciState{
-		DiscordId:       userId,
-		Server:          server,
-		Notes:           notes,
-		ExpiresAt:       time.Now().Add(time.Minute * time.Duration(*d.config.Timeout)),
-		DirectMessageId: dm.ID,
-	}
-	d.save()
-	d.Unlock()
-
 	welcome := "You have been marked on-duty as an active GCI, good luck <:blobsalute:357248938933223434>"
-	if dm == nil {
+	if state.DirectMessageId == "" {
 		welcome += fmt.Sprintf(
 			" (Warning: you have DMs disabled so the bot will not be able to warn you before your GCI session expires. Make sure to /gci refresh every %d minutes!",
-			*d.config.Timeout,
+			d.http.gcis.timeout,
 		)
 	}
 
@@ -126,32 +166,21 @@ func (d *DiscordIntegration) commandGCISunrise(w http.ResponseWriter, interactio
 }
 
 func (d *DiscordIntegration) commandGCISunset(w http.ResponseWriter, interaction *discordgo.Interaction, userId string) {
-	d.Lock()
-	_, ok := d.gcis[userId]
-	if !ok {
+	err := d.http.gcis.sunset(userId)
+	if err != nil {
 		respondWithMessage(w, "You are not on-duty as a GCI.")
 	} else {
-		delete(d.gcis, userId)
-		d.save()
 		respondWithMessage(w, "You have been marked off-duty. Thanks for your service <:blobsalute:357248938933223434>")
 	}
-	d.Unlock()
-
 }
 
 func (d *DiscordIntegration) commandGCIRefresh(w http.ResponseWriter, interaction *discordgo.Interaction, userId string) {
-	d.Lock()
-	gci, ok := d.gcis[userId]
-	if !ok {
+	_, err := d.http.gcis.refresh(userId, nil)
+	if err != nil {
 		respondWithMessage(w, "You are not on-duty as a GCI.")
 	} else {
-		gci.ExpiresAt = time.Now().Add(time.Minute * time.Duration(*d.config.Timeout))
-		gci.Warned = false
-		d.save()
-		respondWithMessage(w, fmt.Sprintf("Your GCI session has been refreshed for another %d minutes.", *d.config.Timeout))
+		respondWithMessage(w, fmt.Sprintf("Your GCI session has been refreshed for another %d minutes.", d.http.gcis.timeout))
 	}
-	d.Unlock()
-
 }
 
 func (d *DiscordIntegration) commandSneakerStatus(
@@ -161,8 +190,8 @@ func (d *DiscordIntegration) commandSneakerStatus(
 ) {
 	var serverName string
 	if len(options) == 0 {
-		if len(d.http.config.Servers) > 0 {
-			serverName = d.http.config.Servers[0].Name
+		if servers := d.http.getServers(); len(servers) > 0 {
+			serverName = servers[0].Name
 		} else {
 			respondWithMessage(w, fmt.Sprintf("No servers available to GCI on."))
 			return
@@ -175,16 +204,22 @@ func (d *DiscordIntegration) commandSneakerStatus(
 	if err != nil {
 		respondWithMessage(w, fmt.Sprintf("No server named '%s'.", serverName))
 	} else {
-		d.RLock()
-		gcis := []*gciState{}
-		for _, gci := range d.gcis {
-			if gci.Server == serverName {
-				gcis = append(gcis, gci)
-			}
+		gcis := d.http.gcis.list(serverName)
+
+		playerList := session.GetPlayerList("")
+
+		// Anyone in the channel can run this, so fog of war servers only report
+		// how many players are flying
+		if session.server.EnableFogOfWar {
+			respondWithMessage(w, fmt.Sprintf(
+				"%s Status\n**Flying**: %d\n**GCI**: %s",
+				strings.ToUpper(serverName),
+				len(playerList),
+				formatGCIList(gcis),
+			))
+			return
 		}
-		d.RUnlock()
 
-		playerList := session.GetPlayerList()
 		respondWithMessage(w, fmt.Sprintf(
 			"%s Status\n**Flying**: %d\n**GCI**: %s\n**Players**: \n```\n%s\n```",
 			strings.ToUpper(serverName),
@@ -197,12 +232,7 @@ func (d *DiscordIntegration) commandSneakerStatus(
 }
 
 func (d *DiscordIntegration) commandGCIInfo(w http.ResponseWriter, interaction *discordgo.Interaction) {
-	d.RLock()
-	gcis := []*gciState{}
-	for _, gci := range d.gcis {
-		gcis = append(gcis, gci)
-	}
-	d.RUnlock()
+	gcis := d.http.gcis.list("")
 	respondWithMessage(w, fmt.Sprintf("**Active GCIs**: %s", formatGCIList(gcis)))
 }
 
@@ -226,6 +256,7 @@ func (d *DiscordIntegration) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if interaction.Type == discordgo.InteractionPing {
+		d.metrics.recordInteraction("ping")
 		gores.JSON(w, 200, discordgo.InteractionResponse{
 			Type: discordgo.InteractionResponsePong,
 		})
@@ -233,6 +264,12 @@ func (d *DiscordIntegration) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	} else if interaction.Type == discordgo.InteractionApplicationCommand {
 		data := interaction.ApplicationCommandData()
 
+		command := data.Name
+		if data.Name == "gci" && len(data.Options) > 0 {
+			command += " " + data.Options[0].Name
+		}
+		d.metrics.recordInteraction(command)
+
 		if data.Name == "gci" {
 			switch data.Options[0].Name {
 			case "info":
@@ -249,6 +286,7 @@ func (d *DiscordIntegration) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 	} else if interaction.Type == discordgo.InteractionMessageComponent {
 		data := interaction.MessageComponentData()
+		d.metrics.recordInteraction(data.CustomID)
 
 		if data.CustomID == "refresh-gci" {
 			gores.JSON(w, 200, discordgo.InteractionResponse{
@@ -256,13 +294,8 @@ func (d *DiscordIntegration) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 				Data: &discordgo.InteractionResponseData{},
 			})
 
-			d.Lock()
-			gci, ok := d.gcis[userId]
-			if ok {
-				gci.ExpiresAt = time.Now().Add(time.Minute * time.Duration(*d.config.Timeout))
-				gci.Warned = false
-				d.save()
-
+			_, err = d.http.gcis.refresh(userId, nil)
+			if err == nil {
 				err = d.session.InteractionRespond(
 					&interaction,
 					&discordgo.InteractionResponse{
@@ -286,7 +319,6 @@ func (d *DiscordIntegration) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 					},
 				)
 			}
-			d.Unlock()
 		}
 		return
 	}
@@ -294,29 +326,18 @@ func (d *DiscordIntegration) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	gores.NoContent(w)
 }
 
-// Returns a copy of the GCI list for a given server
-func (d *DiscordIntegration) GetGCIList(serverName string) []gciState {
-	d.RLock()
-	defer d.RUnlock()
-	result := []gciState{}
-	for _, gci := range d.gcis {
-		if gci.Server != serverName {
-			continue
-		}
-
-		result = append(result, *gci)
-	}
-	return result
-}
-
-func formatGCIList(gciList []*gciState) string {
+func formatGCIList(gciList []gciState) string {
 	if len(gciList) == 0 {
 		return "none"
 	}
 
 	table := []string{}
 	for _, gci := range gciList {
-		table = append(table, fmt.Sprintf("  <@%s> - %v", gci.DiscordId, gci.Notes))
+		name := gci.Name
+		if gci.DiscordId != "" {
+			name = fmt.Sprintf("<@%s>", gci.DiscordId)
+		}
+		table = append(table, fmt.Sprintf("  %s - %v", name, gci.Notes))
 	}
 
 	return strings.Join(table, "\n")
@@ -339,73 +360,6 @@ func formatPlayerListTable(playerList []PlayerMetadata) string {
 	return strings.Join(table, "\n")
 }
 
-// assumes you have a write lock
-func (d *DiscordIntegration) save() {
-	if d.config.StatePath == nil {
-		return
-	}
-
-	data, err := json.Marshal(d.gcis)
-	if err != nil {
-		panic(err)
-	}
-
-	err = ioutil.WriteFile(*d.config.StatePath, data, os.ModePerm)
-	if err != nil {
-		log.Printf("error: failed to save GCI state file: %v", err)
-	}
-}
-
-func (d *DiscordIntegration) expireLoop() {
-	for {
-		d.Lock()
-		for id, gci := range d.gcis {
-			if gci.ExpiresAt.Before(time.Now().Add(time.Second * 10)) {
-				delete(d.gcis, id)
-				_, err := d.session.ChannelMessageSend(
-					gci.DirectMessageId, "Your GCI session has expired. Please re-sunrise if you are not done yet.",
-				)
-				if err != nil {
-					log.Printf("warning: failed to send GCI expiry warning: %v", err)
-					continue
-				}
-			} else if gci.ExpiresAt.Before(time.Now().Add(time.Minute*time.Duration(*d.config.Reminder))) && !gci.Warned {
-				gci.Warned = true
-
-				data := &discordgo.MessageSend{
-					Content: fmt.Sprintf(
-						"Your GCI session expires in %d minutes! Please /gci refresh if you are not done yet.",
-						*d.config.Reminder,
-					),
-					Components: []discordgo.MessageComponent{
-						&discordgo.ActionsRow{
-							Components: []discordgo.MessageComponent{
-								&discordgo.Button{
-									Label:    "Refresh",
-									CustomID: "refresh-gci",
-									Style:    discordgo.SuccessButton,
-								},
-							},
-						},
-					},
-				}
-				_, err := d.session.ChannelMessageSendComplex(
-					gci.DirectMessageId,
-					data,
-				)
-				if err != nil {
-					log.Printf("warning: failed to send GCI expiry warning: %v", err)
-					continue
-				}
-			}
-		}
-		d.save()
-		d.Unlock()
-
-		time.Sleep(time.Second * 60)
-	}
-}
-
 func (d *DiscordIntegration) Setup() error {
 	_, err := d.session.ApplicationCommandCreate(d.config.ApplicationID, "", &discordgo.ApplicationCommand{
 		Name:        "gci",
@@ -462,25 +416,6 @@ func (d *DiscordIntegration) Setup() error {
 		return err
 	}
 
-	if d.config.StatePath != nil {
-		_, err := os.Stat(*d.config.StatePath)
-
-		if err != nil {
-			if !os.IsNotExist(err) {
-				return err
-			}
-		} else {
-			data, err := ioutil.ReadFile(*d.config.StatePath)
-			if err != nil {
-				return err
-			}
-			err = json.Unmarshal(data, &d.gcis)
-			if err != nil {
-				return err
-			}
-		}
-	}
-
-	go d.expireLoop()
+	d.http.gcis.addNotifier(d)
 	return nil
 }
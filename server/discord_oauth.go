@@ -0,0 +1,369 @@
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/alioygur/gores"
+)
+
+const (
+	discordAuthorizeURL = "https://discord.com/api/oauth2/authorize"
+	discordTokenURL     = "https://discord.com/api/oauth2/token"
+	discordUserURL      = "https://discord.com/api/users/@me"
+)
+
+const (
+	webSessionCookie   = "sneaker_session"
+	webStateCookie     = "sneaker_oauth_state"
+	webSessionDuration = time.Hour * 24 * 7
+	webStateDuration   = time.Minute * 10
+)
+
+var errInvalidWebSession = errors.New("invalid session cookie")
+
+// A user logged into the web UI through Discord, stored in a signed cookie
+type webUser struct {
+	Id        string `json:"id"`
+	Username  string `json:"username"`
+	Avatar    string `json:"avatar"`
+	ExpiresAt int64  `json:"expires_at"`
+}
+
+type webUserContextKey struct{}
+
+// Returns the user logged into the web UI, or nil if there is none
+func getWebUser(r *http.Request) *webUser {
+	user, _ := r.Context().Value(webUserContextKey{}).(*webUser)
+	return user
+}
+
+// Returns whether logging into the web UI is configured
+func (d *DiscordIntegration) oauthEnabled() bool {
+	return d.config.ClientSecret != "" && d.config.RedirectURL != ""
+}
+
+// Returns the key used to sign session cookies
+func getSessionSecret(config *DiscordIntegrationConfig) []byte {
+	if config.SessionSecret != nil {
+		return []byte(*config.SessionSecret)
+	}
+
+	secret := make([]byte, 32)
+	_, err := rand.Read(secret)
+	if err != nil {
+		log.Panicf("Failed to generate session secret: %v", err)
+	}
+	return secret
+}
+
+func (d *DiscordIntegration) sign(payload string) string {
+	mac := hmac.New(sha256.New, d.sessionSecret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (d *DiscordIntegration) encodeWebSession(user *webUser) (string, error) {
+	data, err := json.Marshal(user)
+	if err != nil {
+		return "", err
+	}
+
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	return payload + "." + d.sign(payload), nil
+}
+
+func (d *DiscordIntegration) decodeWebSession(value string) (*webUser, error) {
+	parts := strings.SplitN(value, ".", 2)
+	if len(parts) != 2 || !hmac.Equal([]byte(parts[1]), []byte(d.sign(parts[0]))) {
+		return nil, errInvalidWebSession
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errInvalidWebSession
+	}
+
+	var user webUser
+	err = json.Unmarshal(data, &user)
+	if err != nil || time.Now().Unix() > user.ExpiresAt {
+		return nil, errInvalidWebSession
+	}
+	return &user, nil
+}
+
+// Returns whether cookies are only sent over HTTPS, by default when the web UI is
+// served over HTTPS (directly or judging by the OAuth2 redirect behind a proxy)
+func (d *DiscordIntegration) secureCookies(r *http.Request) bool {
+	if d.config.SecureCookies != nil {
+		return *d.config.SecureCookies
+	}
+	return r.TLS != nil || strings.HasPrefix(d.config.RedirectURL, "https://")
+}
+
+func (d *DiscordIntegration) setCookie(w http.ResponseWriter, r *http.Request, name string, value string, maxAge time.Duration) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   int(maxAge.Seconds()),
+		HttpOnly: true,
+		Secure:   d.secureCookies(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// Attaches the user logged into the web UI to requests carrying a valid session cookie
+func (d *DiscordIntegration) sessionMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cookie, err := r.Cookie(webSessionCookie)
+		if err == nil {
+			user, err := d.decodeWebSession(cookie.Value)
+			if err == nil {
+				r = r.WithContext(context.WithValue(r.Context(), webUserContextKey{}, user))
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Redirects the browser to Discord to authorize the login
+func (d *DiscordIntegration) oauthLogin(w http.ResponseWriter, r *http.Request) {
+	state := make([]byte, 16)
+	_, err := rand.Read(state)
+	if err != nil {
+		gores.Error(w, 500, "failed to generate state")
+		return
+	}
+	stateValue := hex.EncodeToString(state)
+	d.setCookie(w, r, webStateCookie, stateValue, webStateDuration)
+
+	query := url.Values{}
+	query.Set("client_id", d.config.ApplicationID)
+	query.Set("redirect_uri", d.config.RedirectURL)
+	query.Set("response_type", "code")
+	query.Set("scope", "identify")
+	query.Set("state", stateValue)
+	http.Redirect(w, r, discordAuthorizeURL+"?"+query.Encode(), http.StatusFound)
+}
+
+// Completes the login, issuing a session cookie for the Discord user
+func (d *DiscordIntegration) oauthCallback(w http.ResponseWriter, r *http.Request) {
+	state, err := r.Cookie(webStateCookie)
+	if err != nil || state.Value == "" || !hmac.Equal([]byte(state.Value), []byte(r.URL.Query().Get("state"))) {
+		gores.Error(w, 400, "invalid state")
+		return
+	}
+	d.setCookie(w, r, webStateCookie, "", -time.Second)
+
+	code := r.URL.Query().Get("code")
+	if code == "" {
+		gores.Error(w, 400, "missing code")
+		return
+	}
+
+	user, err := d.fetchOAuthUser(code)
+	if err != nil {
+		log.Printf("error: failed to complete discord login: %v", err)
+		gores.Error(w, 502, "failed to complete discord login")
+		return
+	}
+
+	user.ExpiresAt = time.Now().Add(webSessionDuration).Unix()
+	value, err := d.encodeWebSession(user)
+	if err != nil {
+		gores.Error(w, 500, "failed to create session")
+		return
+	}
+
+	d.setCookie(w, r, webSessionCookie, value, webSessionDuration)
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+// Exchanges an authorization code for the Discord user it was issued to
+func (d *DiscordIntegration) fetchOAuthUser(code string) (*webUser, error) {
+	form := url.Values{}
+	form.Set("client_id", d.config.ApplicationID)
+	form.Set("client_secret", d.config.ClientSecret)
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", d.config.RedirectURL)
+
+	client := &http.Client{Timeout: time.Second * 10}
+	res, err := client.PostForm(discordTokenURL, form)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("token exchange failed with status %v", res.StatusCode)
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+	}
+	err = json.NewDecoder(res.Body).Decode(&token)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("GET", discordUserURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token.AccessToken)
+
+	userRes, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer userRes.Body.Close()
+	if userRes.StatusCode != 200 {
+		return nil, fmt.Errorf("fetching user failed with status %v", userRes.StatusCode)
+	}
+
+	var user webUser
+	err = json.NewDecoder(userRes.Body).Decode(&user)
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// Logs the user out of the web UI
+func (d *DiscordIntegration) oauthLogout(w http.ResponseWriter, r *http.Request) {
+	d.setCookie(w, r, webSessionCookie, "", -time.Second)
+	gores.NoContent(w)
+}
+
+type meGCIMetadata struct {
+	Server    string    `json:"server"`
+	Notes     string    `json:"notes"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type meMetadata struct {
+	Id       string         `json:"id"`
+	Username string         `json:"username"`
+	Avatar   string         `json:"avatar"`
+	GCI      *meGCIMetadata `json:"gci"`
+}
+
+// Returns the logged in user, writing an error response if there is none
+func ensureWebUser(w http.ResponseWriter, r *http.Request) *webUser {
+	user := getWebUser(r)
+	if user == nil {
+		gores.Error(w, 401, "not logged in")
+	}
+	return user
+}
+
+// Returns the logged in user and their GCI duty
+func (d *DiscordIntegration) getMe(w http.ResponseWriter, r *http.Request) {
+	user := ensureWebUser(w, r)
+	if user == nil {
+		return
+	}
+
+	result := meMetadata{Id: user.Id, Username: user.Username, Avatar: user.Avatar}
+	if gci := d.http.gcis.get(user.Id); gci != nil {
+		result.GCI = &meGCIMetadata{Server: gci.Server, Notes: gci.Notes, ExpiresAt: gci.ExpiresAt}
+	}
+
+	gores.JSON(w, 200, result)
+}
+
+type meSunriseRequest struct {
+	Server string `json:"server"`
+	Notes  string `json:"notes"`
+}
+
+// Marks the logged in user on-duty as a GCI
+func (d *DiscordIntegration) sunriseMe(w http.ResponseWriter, r *http.Request) {
+	user := ensureWebUser(w, r)
+	if user == nil {
+		return
+	}
+
+	var req meSunriseRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		gores.Error(w, 400, "failed to decode request")
+		return
+	}
+
+	if !d.http.ensureRole(w, r, req.Server, roleGCI) {
+		return
+	}
+
+	_, err = d.sunrise(user.Id, user.Username, req.Server, req.Notes)
+	if err == errGCIAlreadyActive {
+		gores.Error(w, 409, "already on-duty as a GCI")
+		return
+	} else if err != nil {
+		gores.Error(w, 404, "server not found")
+		return
+	}
+
+	d.getMe(w, r)
+}
+
+// Returns the GCI duty of the logged in user, writing an error response and
+// returning nil if they are not on-duty or no longer have the gci role
+func (d *DiscordIntegration) ensureMyGCI(w http.ResponseWriter, r *http.Request, user *webUser) *gciState {
+	gci := d.http.gcis.get(user.Id)
+	if gci == nil {
+		gores.Error(w, 404, "not on-duty as a GCI")
+		return nil
+	}
+
+	if !d.http.ensureRole(w, r, gci.Server, roleGCI) {
+		return nil
+	}
+	return gci
+}
+
+// Marks the logged in user off-duty
+func (d *DiscordIntegration) sunsetMe(w http.ResponseWriter, r *http.Request) {
+	user := ensureWebUser(w, r)
+	if user == nil || d.ensureMyGCI(w, r, user) == nil {
+		return
+	}
+
+	err := d.http.gcis.sunset(user.Id)
+	if err != nil {
+		gores.Error(w, 404, "not on-duty as a GCI")
+		return
+	}
+
+	d.getMe(w, r)
+}
+
+// Extends the GCI duty of the logged in user
+func (d *DiscordIntegration) refreshMe(w http.ResponseWriter, r *http.Request) {
+	user := ensureWebUser(w, r)
+	if user == nil || d.ensureMyGCI(w, r, user) == nil {
+		return
+	}
+
+	_, err := d.http.gcis.refresh(user.Id, nil)
+	if err != nil {
+		gores.Error(w, 404, "not on-duty as a GCI")
+		return
+	}
+
+	d.getMe(w, r)
+}
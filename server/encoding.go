@@ -0,0 +1,76 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+func init() {
+	// Times are encoded as RFC3339 strings like in the JSON encoding, rather than
+	// MessagePack timestamp extensions
+	msgpack.Register(time.Time{}, func(e *msgpack.Encoder, v reflect.Value) error {
+		return e.EncodeString(v.Interface().(time.Time).Format(time.RFC3339Nano))
+	}, nil)
+}
+
+// Wire formats events can be encoded in, JSON is the default
+const (
+	eventFormatJSON    = "json"
+	eventFormatMsgPack = "msgpack"
+)
+
+var errInvalidEventFormat = errors.New("invalid event format")
+
+// Parses a user-provided event format, an empty value selects JSON
+func parseEventFormat(value string) (string, error) {
+	switch value {
+	case "", eventFormatJSON:
+		return eventFormatJSON, nil
+	case eventFormatMsgPack:
+		return eventFormatMsgPack, nil
+	}
+	return "", errInvalidEventFormat
+}
+
+// An event encoded in the `{"e", "d"}` envelope sent to clients
+type sessionEvent struct {
+	name    string
+	encoded []byte
+}
+
+func encodeEvent(format string, event string, data interface{}) (sessionEvent, error) {
+	envelope := map[string]interface{}{
+		"e": event,
+		"d": data,
+	}
+
+	var encoded []byte
+	var err error
+	if format == eventFormatMsgPack {
+		encoded, err = encodeMsgPack(envelope)
+	} else {
+		encoded, err = json.Marshal(envelope)
+	}
+	if err != nil {
+		return sessionEvent{}, err
+	}
+	return sessionEvent{name: event, encoded: encoded}, nil
+}
+
+// Encodes a value as MessagePack, using the same field names as the JSON encoding
+func encodeMsgPack(value interface{}) ([]byte, error) {
+	var buffer bytes.Buffer
+	encoder := msgpack.NewEncoder(&buffer)
+	encoder.SetCustomStructTag("json")
+
+	err := encoder.Encode(value)
+	if err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
@@ -0,0 +1,40 @@
+package server
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+func TestEncodeEventTimesMatchJSON(t *testing.T) {
+	connectedAt := time.Date(2022, 1, 26, 18, 40, 2, 518230000, time.UTC)
+	data := &sessionStatusData{State: upstreamConnected, ConnectedAt: &connectedAt}
+
+	encodedJSON, err := encodeEvent(eventFormatJSON, "SESSION_STATUS", data)
+	if err != nil {
+		t.Fatalf("failed to encode JSON: %v", err)
+	}
+	encodedMsgPack, err := encodeEvent(eventFormatMsgPack, "SESSION_STATUS", data)
+	if err != nil {
+		t.Fatalf("failed to encode MessagePack: %v", err)
+	}
+
+	var fromJSON, fromMsgPack map[string]interface{}
+	if err := json.Unmarshal(encodedJSON.encoded, &fromJSON); err != nil {
+		t.Fatalf("failed to decode JSON: %v", err)
+	}
+	if err := msgpack.Unmarshal(encodedMsgPack.encoded, &fromMsgPack); err != nil {
+		t.Fatalf("failed to decode MessagePack: %v", err)
+	}
+
+	jsonData := fromJSON["d"].(map[string]interface{})
+	msgPackData := fromMsgPack["d"].(map[string]interface{})
+	if msgPackData["connected_at"] != jsonData["connected_at"] {
+		t.Errorf("expected connected_at %v, got %v", jsonData["connected_at"], msgPackData["connected_at"])
+	}
+	if msgPackData["last_error_at"] != nil {
+		t.Errorf("expected a nil last_error_at, got %v", msgPackData["last_error_at"])
+	}
+}
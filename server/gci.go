@@ -0,0 +1,478 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/alioygur/gores"
+)
+
+// Default number of minutes before a GCI is taken off duty, and before that to remind them
+const (
+	defaultGCITimeout  = 60
+	defaultGCIReminder = 5
+)
+
+var (
+	errGCIAlreadyActive = errors.New("already registered as an active GCI")
+	errGCINotActive     = errors.New("not on-duty as a GCI")
+)
+
+type gciState struct {
+	// Identifies the controller, Discord users are identified by their Discord id
+	Id   string
+	Name string
+
+	DiscordId       string
+	Server          string
+	Notes           string
+	ExpiresAt       time.Time
+	Warned          bool
+	DirectMessageId string
+}
+
+// Receives notifications about GCI duty, implemented by frontends such as Discord
+type gciNotifier interface {
+	gciExpiring(gci gciState, remaining time.Duration)
+	gciExpired(gci gciState)
+}
+
+// Tracks which controllers are on-duty on each server
+type gciStore struct {
+	sync.RWMutex
+
+	http      *httpServer
+	statePath *string
+	timeout   int
+	reminder  int
+	notifiers []gciNotifier
+
+	gcis map[string]*gciState
+}
+
+func newGCIStore(http *httpServer, config *Config) *gciStore {
+	store := &gciStore{
+		http:     http,
+		timeout:  defaultGCITimeout,
+		reminder: defaultGCIReminder,
+		gcis:     make(map[string]*gciState),
+	}
+
+	// The GCI settings used to live in the Discord integration config
+	gciConfig := config.GCI
+	if gciConfig == nil && config.Discord != nil {
+		gciConfig = &GCIConfig{
+			StatePath: config.Discord.StatePath,
+			Timeout:   config.Discord.Timeout,
+			Reminder:  config.Discord.Reminder,
+		}
+	}
+
+	if gciConfig != nil {
+		store.statePath = gciConfig.StatePath
+		if gciConfig.Timeout != nil {
+			store.timeout = *gciConfig.Timeout
+		}
+		if gciConfig.Reminder != nil {
+			store.reminder = *gciConfig.Reminder
+		}
+	}
+
+	return store
+}
+
+// Loads the saved GCI state and starts expiring GCIs
+func (g *gciStore) Setup() error {
+	if g.statePath != nil {
+		_, err := os.Stat(*g.statePath)
+
+		if err != nil {
+			if !os.IsNotExist(err) {
+				return err
+			}
+		} else {
+			data, err := ioutil.ReadFile(*g.statePath)
+			if err != nil {
+				return err
+			}
+			err = json.Unmarshal(data, &g.gcis)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// State saved before GCIs had their own id only contains Discord users
+	for id, gci := range g.gcis {
+		if gci.Id == "" {
+			gci.Id = id
+		}
+	}
+
+	go g.expireLoop()
+	return nil
+}
+
+func (g *gciStore) addNotifier(notifier gciNotifier) {
+	g.Lock()
+	defer g.Unlock()
+	g.notifiers = append(g.notifiers, notifier)
+}
+
+func (g *gciStore) expiresAt() time.Time {
+	return time.Now().Add(time.Minute * time.Duration(g.timeout))
+}
+
+// Marks a controller on-duty, filling in its expiry. If the controller is
+// already on-duty their existing state is returned along with errGCIAlreadyActive.
+func (g *gciStore) sunrise(gci gciState) (*gciState, error) {
+	g.http.Lock()
+	_, exists := g.http.sessions[gci.Server]
+	g.http.Unlock()
+	if !exists {
+		return nil, errNoServerFound
+	}
+
+	g.Lock()
+	defer g.Unlock()
+	if state, exists := g.gcis[gci.Id]; exists {
+		result := *state
+		return &result, errGCIAlreadyActive
+	}
+
+	gci.ExpiresAt = g.expiresAt()
+	gci.Warned = false
+	g.gcis[gci.Id] = &gci
+	g.save()
+
+	result := gci
+	return &result, nil
+}
+
+// Marks a controller off-duty
+func (g *gciStore) sunset(id string) error {
+	g.Lock()
+	defer g.Unlock()
+
+	_, ok := g.gcis[id]
+	if !ok {
+		return errGCINotActive
+	}
+
+	delete(g.gcis, id)
+	g.save()
+	return nil
+}
+
+// Marks every controller on a server off-duty, used when the server is removed.
+// Returns the controllers which were on-duty.
+func (g *gciStore) sunsetServer(serverName string) []gciState {
+	g.Lock()
+	defer g.Unlock()
+
+	removed := []gciState{}
+	for id, gci := range g.gcis {
+		if gci.Server == serverName {
+			delete(g.gcis, id)
+			removed = append(removed, *gci)
+		}
+	}
+
+	if len(removed) > 0 {
+		g.save()
+	}
+	return removed
+}
+
+// Extends the duty of an on-duty controller by the configured timeout, optionally
+// replacing their notes
+func (g *gciStore) refresh(id string, notes *string) (*gciState, error) {
+	g.Lock()
+	defer g.Unlock()
+
+	gci, ok := g.gcis[id]
+	if !ok {
+		return nil, errGCINotActive
+	}
+
+	gci.ExpiresAt = g.expiresAt()
+	gci.Warned = false
+	if notes != nil {
+		gci.Notes = *notes
+	}
+	g.save()
+
+	result := *gci
+	return &result, nil
+}
+
+// Returns a copy of a controllers state, or nil if they are not on-duty
+func (g *gciStore) get(id string) *gciState {
+	g.RLock()
+	defer g.RUnlock()
+
+	gci, ok := g.gcis[id]
+	if !ok {
+		return nil
+	}
+
+	result := *gci
+	return &result
+}
+
+// Returns a copy of the GCI list for a given server, or every server if empty
+func (g *gciStore) list(serverName string) []gciState {
+	g.RLock()
+	defer g.RUnlock()
+	result := []gciState{}
+	for _, gci := range g.gcis {
+		if serverName != "" && gci.Server != serverName {
+			continue
+		}
+
+		result = append(result, *gci)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ExpiresAt.Before(result[j].ExpiresAt)
+	})
+	return result
+}
+
+// assumes you have a write lock
+func (g *gciStore) save() {
+	if g.statePath == nil {
+		return
+	}
+
+	data, err := json.Marshal(g.gcis)
+	if err != nil {
+		panic(err)
+	}
+
+	err = ioutil.WriteFile(*g.statePath, data, os.ModePerm)
+	if err != nil {
+		log.Printf("error: failed to save GCI state file: %v", err)
+	}
+}
+
+func (g *gciStore) expireLoop() {
+	for {
+		expired := []gciState{}
+		expiring := []gciState{}
+
+		g.Lock()
+		for id, gci := range g.gcis {
+			if gci.ExpiresAt.Before(time.Now().Add(time.Second * 10)) {
+				delete(g.gcis, id)
+				expired = append(expired, *gci)
+			} else if gci.ExpiresAt.Before(time.Now().Add(time.Minute*time.Duration(g.reminder))) && !gci.Warned {
+				gci.Warned = true
+				expiring = append(expiring, *gci)
+			}
+		}
+		g.save()
+		notifiers := g.notifiers
+		g.Unlock()
+
+		for _, notifier := range notifiers {
+			for _, gci := range expired {
+				notifier.gciExpired(gci)
+			}
+			for _, gci := range expiring {
+				notifier.gciExpiring(gci, time.Minute*time.Duration(g.reminder))
+			}
+		}
+
+		select {
+		case <-time.After(time.Second * 60):
+		case <-g.http.ctx.Done():
+			return
+		}
+	}
+}
+
+// Returns the id, name and Discord id of the controller making a request, which
+// are empty when the request is anonymous
+func getRequestController(r *http.Request) (string, string, string) {
+	if user := getWebUser(r); user != nil {
+		return user.Id, user.Username, user.Id
+	}
+
+	if user, ok := r.Context().Value(authContextKey{}).(*authUser); ok {
+		return user.name, user.name, ""
+	}
+	return "", "", ""
+}
+
+type gciRequest struct {
+	// Controller to act on, defaults to the requester. Acting on another
+	// controller requires the admin role.
+	Id    string  `json:"id"`
+	Name  string  `json:"name"`
+	Notes *string `json:"notes"`
+}
+
+// Resolves the controller a GCI request acts on, writing an error response and
+// returning false if the requester is anonymous or may not act on it. Without
+// auth configured there are no admins, so controllers may only act on themselves.
+func (h *httpServer) ensureGCIController(w http.ResponseWriter, r *http.Request, server *TacViewServerConfig, req *gciRequest) (string, bool) {
+	if !h.ensureRole(w, r, server.Name, roleGCI) {
+		return "", false
+	}
+
+	requesterId, _, _ := getRequestController(r)
+	if requesterId == "" {
+		gores.Error(w, 401, "authentication required")
+		return "", false
+	}
+
+	if req.Id == "" {
+		req.Id = requesterId
+	}
+
+	if req.Id != requesterId {
+		if h.auth == nil {
+			gores.Error(w, 403, "forbidden")
+			return "", false
+		}
+		if !h.ensureRole(w, r, server.Name, roleAdmin) {
+			return "", false
+		}
+	}
+	return req.Id, true
+}
+
+func newGCIMetadata(gci *gciState) gciMetadata {
+	return gciMetadata{
+		Id:        gci.Id,
+		Name:      gci.Name,
+		Notes:     gci.Notes,
+		ExpiresAt: gci.ExpiresAt,
+	}
+}
+
+// Marks a controller on-duty on a server
+func (h *httpServer) createGCI(w http.ResponseWriter, r *http.Request) {
+	server := h.ensureServer(w, r)
+	if server == nil {
+		return
+	}
+
+	var req gciRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		gores.Error(w, 400, "failed to decode request")
+		return
+	}
+
+	id, ok := h.ensureGCIController(w, r, server, &req)
+	if !ok {
+		return
+	}
+
+	var notes string
+	if req.Notes != nil {
+		notes = *req.Notes
+	}
+
+	// Controllers logged in through Discord go on-duty through the integration so
+	// they receive reminders before their duty expires
+	var gci *gciState
+	requesterId, requesterName, discordId := getRequestController(r)
+	if id == requesterId && discordId != "" && h.discord != nil {
+		gci, err = h.discord.sunrise(discordId, requesterName, server.Name, notes)
+	} else {
+		name := req.Name
+		if name == "" && id == requesterId {
+			name = requesterName
+		}
+		if name == "" {
+			name = id
+		}
+
+		if id != requesterId {
+			discordId = ""
+		}
+
+		gci, err = h.gcis.sunrise(gciState{Id: id, Name: name, DiscordId: discordId, Server: server.Name, Notes: notes})
+	}
+
+	if err == errGCIAlreadyActive {
+		gores.Error(w, 409, "already on-duty as a GCI")
+		return
+	} else if err != nil {
+		gores.Error(w, 404, "server not found")
+		return
+	}
+
+	gores.JSON(w, 201, newGCIMetadata(gci))
+}
+
+// Returns the GCI a request acts on, writing an error response and returning nil
+// if it is not on-duty on the requested server
+func (h *httpServer) ensureGCI(w http.ResponseWriter, r *http.Request, req *gciRequest) *gciState {
+	server := h.ensureServer(w, r)
+	if server == nil {
+		return nil
+	}
+
+	id, ok := h.ensureGCIController(w, r, server, req)
+	if !ok {
+		return nil
+	}
+
+	gci := h.gcis.get(id)
+	if gci == nil || gci.Server != server.Name {
+		gores.Error(w, 404, "not on-duty as a GCI")
+		return nil
+	}
+	return gci
+}
+
+// Marks a controller off-duty
+func (h *httpServer) deleteGCI(w http.ResponseWriter, r *http.Request) {
+	gci := h.ensureGCI(w, r, &gciRequest{Id: r.URL.Query().Get("id")})
+	if gci == nil {
+		return
+	}
+
+	err := h.gcis.sunset(gci.Id)
+	if err != nil {
+		gores.Error(w, 404, "not on-duty as a GCI")
+		return
+	}
+
+	gores.NoContent(w)
+}
+
+// Extends a controllers duty, optionally updating their notes
+func (h *httpServer) updateGCI(w http.ResponseWriter, r *http.Request) {
+	var req gciRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil && err != io.EOF {
+		gores.Error(w, 400, "failed to decode request")
+		return
+	}
+
+	gci := h.ensureGCI(w, r, &req)
+	if gci == nil {
+		return
+	}
+
+	gci, err = h.gcis.refresh(gci.Id, req.Notes)
+	if err != nil {
+		gores.Error(w, 404, "not on-duty as a GCI")
+		return
+	}
+
+	gores.JSON(w, 200, newGCIMetadata(gci))
+}
@@ -0,0 +1,43 @@
+package server
+
+import "math"
+
+const earthRadiusMeters = 6371000.0
+const metersPerNauticalMile = 1852.0
+
+func degreesToRadians(degrees float64) float64 {
+	return degrees * math.Pi / 180
+}
+
+// Returns the great-circle distance in meters between two lat/lng pairs
+func haversineDistance(latA, lngA, latB, lngB float64) float64 {
+	dLat := degreesToRadians(latB - latA)
+	dLng := degreesToRadians(lngB - lngA)
+
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(degreesToRadians(latA))*math.Cos(degreesToRadians(latB))*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return earthRadiusMeters * 2 * math.Atan2(math.Sqrt(a), math.Sqrt(1-a))
+}
+
+// Effective earth radius factor used to account for standard atmospheric refraction
+const radarRefractionFactor = 4.0 / 3.0
+
+// Returns the distance in meters to the radar horizon of an antenna or target at
+// the given height above the surface
+func radarHorizon(height float64) float64 {
+	if height <= 0 {
+		return 0
+	}
+	return math.Sqrt(2 * radarRefractionFactor * earthRadiusMeters * height)
+}
+
+// Returns the initial bearing in degrees (0-360) of the great-circle path between two lat/lng pairs
+func initialBearing(latA, lngA, latB, lngB float64) float64 {
+	phiA := degreesToRadians(latA)
+	phiB := degreesToRadians(latB)
+	dLng := degreesToRadians(lngB - lngA)
+
+	y := math.Sin(dLng) * math.Cos(phiB)
+	x := math.Cos(phiA)*math.Sin(phiB) - math.Sin(phiA)*math.Cos(phiB)*math.Cos(dLng)
+	return math.Mod(math.Atan2(y, x)*180/math.Pi+360, 360)
+}
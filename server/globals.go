@@ -0,0 +1,65 @@
+package server
+
+import (
+	"github.com/b1naryth1ef/jambon/tacview"
+)
+
+type SessionBullseye struct {
+	Id        uint64  `json:"id"`
+	Coalition string  `json:"coalition"`
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+// Properties of the Tacview global object (id 0) describing the mission
+type SessionGlobals struct {
+	Title         string `json:"title"`
+	Author        string `json:"author"`
+	Category      string `json:"category"`
+	Briefing      string `json:"briefing"`
+	Theatre       string `json:"theatre"`
+	ReferenceTime string `json:"reference_time"`
+	RecordingTime string `json:"recording_time"`
+
+	Bullseyes []SessionBullseye `json:"bullseyes"`
+}
+
+// Applies the properties sent in an update of the global object
+func (g *SessionGlobals) update(obj *tacview.Object) {
+	for _, prop := range obj.Properties {
+		switch prop.Key {
+		case "Title":
+			g.Title = prop.Value
+		case "Author":
+			g.Author = prop.Value
+		case "Category":
+			g.Category = prop.Value
+		case "Briefing":
+			g.Briefing = prop.Value
+		case "ReferenceTime":
+			g.ReferenceTime = prop.Value
+		case "RecordingTime":
+			g.RecordingTime = prop.Value
+		}
+	}
+}
+
+// Returns a copy of the globals including the bullseyes among the given
+// objects, assumes you have a lock
+func (s *sessionState) getGlobals(objects []*StateObject) *SessionGlobals {
+	result := s.globals
+	result.Bullseyes = []SessionBullseye{}
+	for _, object := range objects {
+		if object.Deleted || !object.HasType("Bullseye") {
+			continue
+		}
+
+		result.Bullseyes = append(result.Bullseyes, SessionBullseye{
+			Id:        object.Id,
+			Coalition: object.Properties["Coalition"],
+			Latitude:  object.Latitude,
+			Longitude: object.Longitude,
+		})
+	}
+	return &result
+}
@@ -1,11 +1,15 @@
 package server
 
 import (
-	"encoding/json"
+	"context"
 	"errors"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/alioygur/gores"
@@ -17,19 +21,42 @@ import (
 type httpServer struct {
 	sync.Mutex
 
+	// Cancelled when the server is shutting down
+	ctx context.Context
+
 	config   *Config
 	sessions map[string]*serverSession
 	discord  *DiscordIntegration
+	auth     *authenticator
+	gcis     *gciStore
+
+	// Held while reloading the config
+	reloadLock sync.Mutex
+
+	// Tracks websocket streams, which are not tracked by the http server once hijacked
+	streams sync.WaitGroup
 }
 
-func newHttpServer(config *Config) *httpServer {
-	return &httpServer{
+// Returns the configured servers, which are replaced when the config is reloaded
+func (h *httpServer) getServers() []TacViewServerConfig {
+	h.Lock()
+	defer h.Unlock()
+	return h.config.Servers
+}
+
+func newHttpServer(ctx context.Context, config *Config) *httpServer {
+	server := &httpServer{
+		ctx:      ctx,
 		config:   config,
 		sessions: make(map[string]*serverSession),
 	}
+	server.gcis = newGCIStore(server, config)
+	return server
 }
 
-func (h *httpServer) getServerMetadata(server *TacViewServerConfig) serverMetadata {
+// Returns the metadata of a server as seen by the requesting user, on servers with
+// fog of war only the players of their coalition are listed
+func (h *httpServer) getServerMetadata(r *http.Request, server *TacViewServerConfig) serverMetadata {
 	result := serverMetadata{
 		Name:            server.Name,
 		GroundUnitModes: getGroundUnitModes(server),
@@ -38,40 +65,45 @@ func (h *httpServer) getServerMetadata(server *TacViewServerConfig) serverMetada
 
 	session, err := h.getOrCreateSession(server.Name)
 	if err == nil {
-		result.Players = session.GetPlayerList()
+		result.Players = []PlayerMetadata{}
+		if !server.EnableFogOfWar {
+			result.Players = session.GetPlayerList("")
+		} else if coalition := h.getCoalition(r, server.Name); coalition != "" {
+			result.Players = session.GetPlayerList(coalition)
+		}
+		result.Status = session.getStatus()
+		result.Globals = session.getGlobals()
 	}
 
-	if h.discord != nil {
-		gciList := h.discord.GetGCIList(server.Name)
-		for _, gciState := range gciList {
-			result.GCIs = append(result.GCIs, gciMetadata{
-				Id:        gciState.DiscordId,
-				Notes:     gciState.Notes,
-				ExpiresAt: gciState.ExpiresAt,
-			})
-		}
+	for _, gci := range h.gcis.list(server.Name) {
+		result.GCIs = append(result.GCIs, newGCIMetadata(&gci))
 	}
 
 	return result
 }
 
-// Returns a list of available servers
+// Returns a list of servers the requesting user can view
 func (h *httpServer) getServerList(w http.ResponseWriter, r *http.Request) {
-	result := make([]serverMetadata, len(h.config.Servers))
-	for idx, server := range h.config.Servers {
-		// note: safe, we're not leaking this reference anywhere
-		result[idx] = h.getServerMetadata(&server)
+	result := []serverMetadata{}
+	for _, server := range h.getServers() {
+		if h.getRole(r, server.Name) < roleViewer {
+			continue
+		}
 
+		// note: safe, we're not leaking this reference anywhere
+		result = append(result, h.getServerMetadata(r, &server))
 	}
 
 	gores.JSON(w, 200, result)
 }
 
 type serverMetadata struct {
-	Name            string           `json:"name"`
-	GroundUnitModes []string         `json:"ground_unit_modes"`
-	Players         []PlayerMetadata `json:"players"`
-	GCIs            []gciMetadata    `json:"gcis"`
+	Name            string             `json:"name"`
+	GroundUnitModes []string           `json:"ground_unit_modes"`
+	Players         []PlayerMetadata   `json:"players"`
+	GCIs            []gciMetadata      `json:"gcis"`
+	Status          *sessionStatusData `json:"status"`
+	Globals         *SessionGlobals    `json:"globals"`
 }
 
 func getGroundUnitModes(config *TacViewServerConfig) []string {
@@ -87,9 +119,12 @@ func getGroundUnitModes(config *TacViewServerConfig) []string {
 
 func (h *httpServer) ensureServer(w http.ResponseWriter, r *http.Request) *TacViewServerConfig {
 	serverName := chi.URLParam(r, "serverName")
+	if !h.ensureRole(w, r, serverName, roleViewer) {
+		return nil
+	}
 
 	var server *TacViewServerConfig
-	for _, checkServer := range h.config.Servers {
+	for _, checkServer := range h.getServers() {
 		if checkServer.Name == serverName {
 			server = &checkServer
 			break
@@ -104,6 +139,7 @@ func (h *httpServer) ensureServer(w http.ResponseWriter, r *http.Request) *TacVi
 
 type gciMetadata struct {
 	Id        string    `json:"id"`
+	Name      string    `json:"name"`
 	Notes     string    `json:"notes"`
 	ExpiresAt time.Time `json:"expires_at"`
 }
@@ -115,7 +151,7 @@ func (h *httpServer) getServer(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	gores.JSON(w, 200, h.getServerMetadata(server))
+	gores.JSON(w, 200, h.getServerMetadata(r, server))
 }
 
 var errNoServerFound = errors.New("no server by that name was found")
@@ -141,7 +177,7 @@ func (h *httpServer) getOrCreateSession(serverName string) (*serverSession, erro
 	}
 
 	var err error
-	h.sessions[serverName], err = newServerSession(server)
+	h.sessions[serverName], err = newServerSession(h.ctx, server)
 	if err != nil {
 		return nil, err
 	}
@@ -150,20 +186,221 @@ func (h *httpServer) getOrCreateSession(serverName string) (*serverSession, erro
 	return h.sessions[serverName], nil
 }
 
-// Streams events for a given server
-func (h *httpServer) streamServerEvents(w http.ResponseWriter, r *http.Request) {
-	session, err := h.getOrCreateSession(chi.URLParam(r, "serverName"))
+func (h *httpServer) ensureSession(w http.ResponseWriter, r *http.Request) *serverSession {
+	serverName := chi.URLParam(r, "serverName")
+	if !h.ensureRole(w, r, serverName, roleViewer) {
+		return nil
+	}
+
+	session, err := h.getOrCreateSession(serverName)
 	if err != nil {
 		if err == errNoServerFound {
 			gores.Error(w, 404, "server not found")
-			return
+			return nil
 		}
 
 		gores.Error(w, 500, "failed to find or create server session")
+		return nil
+	}
+	return session
+}
+
+// Returns the coalition view requested by a client, writing an error response
+// and returning false if the request is invalid. On servers with fog of war the
+// view is always the coalition assigned to the requesting user.
+func (h *httpServer) ensureCoalition(w http.ResponseWriter, r *http.Request, session *serverSession) (string, bool) {
+	coalition, err := parseCoalition(r.URL.Query().Get("coalition"))
+	if err != nil {
+		gores.Error(w, 400, "invalid coalition")
+		return "", false
+	}
+
+	if !session.server.EnableFogOfWar {
+		return coalition, true
+	}
+
+	assigned := h.getCoalition(r, session.server.Name)
+	if assigned == "" {
+		gores.Error(w, 403, "no coalition is assigned to you on this server")
+		return "", false
+	}
+	if coalition != "" && coalition != assigned {
+		gores.Error(w, 403, "forbidden coalition")
+		return "", false
+	}
+	return assigned, true
+}
+
+// Returns the offset requested by a client, writing an error response and
+// returning false if it is invalid
+func ensureOffset(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	offset, err := strconv.ParseInt(r.URL.Query().Get("offset"), 10, 64)
+	if err != nil {
+		gores.Error(w, 400, "invalid offset")
+		return 0, false
+	}
+	return offset, true
+}
+
+// Returns the state of a server at an earlier offset, or the latest state
+func (h *httpServer) getServerState(w http.ResponseWriter, r *http.Request) {
+	session := h.ensureSession(w, r)
+	if session == nil {
+		return
+	}
+
+	coalition, ok := h.ensureCoalition(w, r, session)
+	if !ok {
+		return
+	}
+
+	var offset int64 = latestRewindOffset
+	if r.URL.Query().Get("offset") != "" {
+		offset, ok = ensureOffset(w, r)
+		if !ok {
+			return
+		}
+	}
+
+	gores.JSON(w, 200, session.getRewindState(coalition, offset))
+}
+
+// Returns the track history of an object
+func (h *httpServer) getObjectHistory(w http.ResponseWriter, r *http.Request) {
+	session := h.ensureSession(w, r)
+	if session == nil {
+		return
+	}
+
+	coalition, ok := h.ensureCoalition(w, r, session)
+	if !ok {
+		return
+	}
+
+	objectId, err := strconv.ParseUint(chi.URLParam(r, "objectId"), 10, 64)
+	if err != nil {
+		gores.Error(w, 400, "invalid object id")
+		return
+	}
+
+	history, err := session.getObjectHistory(coalition, objectId)
+	if err != nil {
+		gores.Error(w, 404, "object not found")
+		return
+	}
+
+	gores.JSON(w, 200, history)
+}
+
+// Subscribes a client to the events of a session in the given format, returning
+// the subscription and the initial events to send before any others. Writes an
+// error response and returns false if the request is invalid.
+func (h *httpServer) subscribeClient(w http.ResponseWriter, r *http.Request, session *serverSession, format string) (<-chan sessionEvent, func(), []sessionEvent, bool) {
+	coalition, ok := h.ensureCoalition(w, r, session)
+	if !ok {
+		return nil, nil, nil, false
+	}
+
+	refreshRate, err := parseRefreshRate(r.URL.Query().Get("refresh_rate"))
+	if err != nil {
+		gores.Error(w, 400, "invalid refresh_rate")
+		return nil, nil, nil, false
+	}
+
+	options := subscriberOptions{
+		coalition:   coalition,
+		format:      format,
+		deltas:      r.URL.Query().Get("deltas") == "true",
+		refreshRate: refreshRate,
+		sweep:       r.URL.Query().Get("sweep") == "true",
+	}
+
+	if options.sweep && session.server.SweepOrigin == nil {
+		gores.Error(w, 400, "sweep is not configured for this server")
+		return nil, nil, nil, false
+	}
+
+	var sub <-chan sessionEvent
+	var subCloser func()
+	var initialStateData *sessionStateData
+	var objects []*StateObject
+	var catchUp []*sessionRadarSnapshotData
+	if r.URL.Query().Get("offset") != "" {
+		if options.scoped() {
+			gores.Error(w, 400, "offset cannot be combined with refresh_rate or sweep")
+			return nil, nil, nil, false
+		}
+
+		offset, ok := ensureOffset(w, r)
+		if !ok {
+			return nil, nil, nil, false
+		}
+
+		sub, subCloser, initialStateData, catchUp = session.addRewindSub(options, offset)
+		objects = initialStateData.Objects
+		initialStateData = &sessionStateData{
+			SessionId: initialStateData.SessionId,
+			Offset:    initialStateData.Offset,
+			Globals:   initialStateData.Globals,
+		}
+	} else if options.scoped() {
+		var err error
+		sub, subCloser, initialStateData, objects, err = session.addScopedSub(options)
+		if err != nil {
+			gores.Error(w, 503, err.Error())
+			return nil, nil, nil, false
+		}
+	} else {
+		sub, subCloser = session.addSub(options)
+		initialStateData, objects = session.getInitialState(coalition)
+	}
+
+	initial := []sessionEvent{}
+	addInitial := func(event string, data interface{}) {
+		encoded, err := encodeEvent(format, event, data)
+		if err != nil {
+			log.Printf("error: failed to encode initial %v event: %v", event, err)
+			return
+		}
+		initial = append(initial, encoded)
+	}
+
+	addInitial("SESSION_STATUS", session.getStatus())
+
+	if initialStateData != nil {
+		addInitial("SESSION_STATE", initialStateData)
+
+		addInitial("SESSION_RADAR_SNAPSHOT", &sessionRadarSnapshotData{
+			Offset:  initialStateData.Offset,
+			Created: objects,
+			Updated: []*StateObject{},
+			Deleted: []uint64{},
+		})
+	}
+
+	// When rewinding, replay the snapshots between the requested offset and now
+	for _, snapshot := range catchUp {
+		if options.deltas {
+			addInitial("SESSION_RADAR_SNAPSHOT", snapshot.toDeltas())
+		} else {
+			addInitial("SESSION_RADAR_SNAPSHOT", snapshot)
+		}
+	}
+
+	return sub, subCloser, initial, true
+}
+
+// Streams events for a given server
+func (h *httpServer) streamServerEvents(w http.ResponseWriter, r *http.Request) {
+	session := h.ensureSession(w, r)
+	if session == nil {
 		return
 	}
 
-	sub, subCloser := session.addSub()
+	sub, subCloser, initial, ok := h.subscribeClient(w, r, session, eventFormatJSON)
+	if !ok {
+		return
+	}
 	defer subCloser()
 
 	f, ok := w.(http.Flusher)
@@ -177,33 +414,17 @@ func (h *httpServer) streamServerEvents(w http.ResponseWriter, r *http.Request)
 	w.Header().Set("Connection", "keep-alive")
 	w.Header().Set("Transfer-Encoding", "chunked")
 
-	publish := func(event string, data interface{}) {
-		encoded, err := json.Marshal(map[string]interface{}{
-			"e": event,
-			"d": data,
-		})
-		if err != nil {
-			return
-		}
-
+	publish := func(msg sessionEvent) {
 		outgoing := []byte("data: ")
-		outgoing = append(outgoing, encoded...)
+		outgoing = append(outgoing, msg.encoded...)
 		outgoing = append(outgoing, '\n', '\n')
 		w.Write(outgoing)
 		f.Flush()
 	}
 
 	// Send initial data
-	initialStateData, objects := session.getInitialState()
-	if initialStateData != nil {
-		publish("SESSION_STATE", initialStateData)
-
-		publish("SESSION_RADAR_SNAPSHOT", &sessionRadarSnapshotData{
-			Offset:  initialStateData.Offset,
-			Created: objects,
-			Updated: []*StateObject{},
-			Deleted: []uint64{},
-		})
+	for _, msg := range initial {
+		publish(msg)
 	}
 
 	done := make(chan struct{})
@@ -221,11 +442,7 @@ func (h *httpServer) streamServerEvents(w http.ResponseWriter, r *http.Request)
 				return
 			}
 
-			outgoing := []byte("data: ")
-			outgoing = append(outgoing, msg...)
-			outgoing = append(outgoing, '\n', '\n')
-			w.Write(outgoing)
-			f.Flush()
+			publish(msg)
 		case <-done:
 			return
 		}
@@ -234,18 +451,38 @@ func (h *httpServer) streamServerEvents(w http.ResponseWriter, r *http.Request)
 }
 
 func Run(config *Config) error {
-	server := newHttpServer(config)
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	server := newHttpServer(ctx, config)
 
 	r := chi.NewRouter()
+	r.Use(redactRequestToken)
 	r.Use(middleware.Logger)
 	r.Use(cors.Handler(cors.Options{
 		AllowedOrigins:   []string{"https://*", "http://*"},
-		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
+		AllowedMethods:   []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
 		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type"},
 		AllowCredentials: false,
 		MaxAge:           300,
 	}))
 
+	if config.Discord != nil {
+		server.discord = NewDiscordIntegration(server, config.Discord)
+		if server.discord.oauthEnabled() {
+			r.Use(server.discord.sessionMiddleware)
+		}
+	}
+
+	if config.Auth != nil {
+		var err error
+		server.auth, err = newAuthenticator(config.Auth)
+		if err != nil {
+			return err
+		}
+		r.Use(server.auth.middleware)
+	}
+
 	r.Get("/*", func(w http.ResponseWriter, r *http.Request) {
 		server.serveEmbeddedFile("index.html", w, r)
 	})
@@ -253,21 +490,108 @@ func Run(config *Config) error {
 	r.Get("/api/servers", server.getServerList)
 	r.Get("/api/servers/{serverName}", server.getServer)
 	r.Get("/api/servers/{serverName}/events", server.streamServerEvents)
+	r.Get("/api/servers/{serverName}/ws", server.streamServerWebSocket)
+	r.Get("/api/servers/{serverName}/state", server.getServerState)
+	r.Get("/api/servers/{serverName}/status", server.getServerStatus)
+	r.Get("/api/servers/{serverName}/missions", server.getServerMissions)
+	r.Get("/api/servers/{serverName}/objects/{objectId}/history", server.getObjectHistory)
+	r.Post("/api/servers/{serverName}/gcis", server.createGCI)
+	r.Patch("/api/servers/{serverName}/gcis", server.updateGCI)
+	r.Delete("/api/servers/{serverName}/gcis", server.deleteGCI)
+	r.Get("/metrics", server.getMetrics)
+
+	// Without auth anyone would be able to reload the config, SIGHUP still works
+	if server.auth != nil {
+		r.Post("/api/admin/reload", server.reloadConfig)
+	}
 
-	if config.Discord != nil {
-		server.discord = NewDiscordIntegration(server, config.Discord)
+	if server.discord != nil {
 		r.Handle("/api/discord/*", server.discord)
 
+		if server.discord.oauthEnabled() {
+			r.Get("/api/auth/discord/login", server.discord.oauthLogin)
+			r.Get("/api/auth/discord/callback", server.discord.oauthCallback)
+			r.Post("/api/auth/logout", server.discord.oauthLogout)
+			r.Get("/api/me", server.discord.getMe)
+			r.Post("/api/me/gci", server.discord.sunriseMe)
+			r.Delete("/api/me/gci", server.discord.sunsetMe)
+			r.Post("/api/me/gci/refresh", server.discord.refreshMe)
+		}
+
 		err := server.discord.Setup()
 		if err != nil {
 			log.Panicf("Failed to setup discord integration: %v", err)
 		}
 	}
 
+	err := server.gcis.Setup()
+	if err != nil {
+		return err
+	}
+
 	log.Printf("Starting up %v Tacview clients", len(config.Servers))
 	for _, serverConfig := range config.Servers {
 		server.getOrCreateSession(serverConfig.Name)
 	}
+	server.watchReloadSignal()
+
+	listener := &http.Server{Addr: config.Bind, Handler: r}
+	errs := make(chan error, 1)
+	go func() {
+		errs <- listener.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+	}
+
+	// Restore the default signal handling so a second signal exits immediately
+	cancel()
+	log.Printf("Shutting down")
+	return server.shutdown(listener)
+}
+
+// Time allowed for clients to disconnect when shutting down
+const shutdownTimeout = time.Second * 10
+
+// Stops every session, waits for streaming clients to receive their final event
+// and saves the GCI state
+func (h *httpServer) shutdown(listener *http.Server) error {
+	h.Lock()
+	sessions := make([]*serverSession, 0, len(h.sessions))
+	for _, session := range h.sessions {
+		sessions = append(sessions, session)
+	}
+	h.Unlock()
+
+	for _, session := range sessions {
+		session.stop("shutdown")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	err := listener.Shutdown(ctx)
+	if err != nil {
+		log.Printf("error: failed to shutdown http server: %v", err)
+	}
+
+	streamsDone := make(chan struct{})
+	go func() {
+		h.streams.Wait()
+		close(streamsDone)
+	}()
+
+	select {
+	case <-streamsDone:
+	case <-ctx.Done():
+		log.Printf("warning: timed out waiting for websocket clients to disconnect")
+	}
 
-	return http.ListenAndServe(config.Bind, r)
+	h.gcis.Lock()
+	h.gcis.save()
+	h.gcis.Unlock()
+	return nil
 }
@@ -0,0 +1,172 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Counters tracked for each session, updated with atomic operations
+type sessionMetrics struct {
+	droppedSubscribers int64
+	reconnects         int64
+	timeFrames         int64
+	snapshots          int64
+	snapshotBytes      int64
+}
+
+// Counts Discord interactions by command
+type discordMetrics struct {
+	sync.Mutex
+
+	interactions map[string]int64
+}
+
+func (m *discordMetrics) recordInteraction(command string) {
+	m.Lock()
+	defer m.Unlock()
+	if m.interactions == nil {
+		m.interactions = make(map[string]int64)
+	}
+	m.interactions[command]++
+}
+
+// Writes metrics in the Prometheus text exposition format
+type metricsWriter struct {
+	builder strings.Builder
+}
+
+var metricsLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func (m *metricsWriter) describe(name string, kind string, help string) {
+	fmt.Fprintf(&m.builder, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// Writes a sample, labels are given as name and value pairs
+func (m *metricsWriter) sample(name string, value interface{}, labels ...string) {
+	m.builder.WriteString(name)
+	if len(labels) > 0 {
+		m.builder.WriteString("{")
+		for idx := 0; idx+1 < len(labels); idx += 2 {
+			if idx > 0 {
+				m.builder.WriteString(",")
+			}
+			fmt.Fprintf(&m.builder, `%s="%s"`, labels[idx], metricsLabelEscaper.Replace(labels[idx+1]))
+		}
+		m.builder.WriteString("}")
+	}
+	fmt.Fprintf(&m.builder, " %v\n", value)
+}
+
+type sessionMetricsSample struct {
+	server             string
+	objects            int
+	subscribers        int
+	droppedSubscribers int64
+	reconnects         int64
+	timeFrames         int64
+	snapshots          int64
+	snapshotBytes      int64
+	lastErrorClass     string
+	lastErrorAt        time.Time
+}
+
+// Returns the current metrics of a session
+func (s *serverSession) sampleMetrics() sessionMetricsSample {
+	s.state.RLock()
+	objects := len(s.state.objects)
+	s.state.RUnlock()
+
+	s.Lock()
+	subscribers := len(s.subscribers)
+	lastErrorClass, lastErrorAt := s.lastErrorClass, s.lastErrorAt
+	s.Unlock()
+
+	return sessionMetricsSample{
+		server:             s.server.Name,
+		objects:            objects,
+		subscribers:        subscribers,
+		droppedSubscribers: atomic.LoadInt64(&s.metrics.droppedSubscribers),
+		reconnects:         atomic.LoadInt64(&s.metrics.reconnects),
+		timeFrames:         atomic.LoadInt64(&s.metrics.timeFrames),
+		snapshots:          atomic.LoadInt64(&s.metrics.snapshots),
+		snapshotBytes:      atomic.LoadInt64(&s.metrics.snapshotBytes),
+		lastErrorClass:     lastErrorClass,
+		lastErrorAt:        lastErrorAt,
+	}
+}
+
+// Exposes metrics for Prometheus, requires the admin role for every server
+func (h *httpServer) getMetrics(w http.ResponseWriter, r *http.Request) {
+	if !h.ensureRole(w, r, authAnyServer, roleAdmin) {
+		return
+	}
+
+	h.Lock()
+	sessions := make([]*serverSession, 0, len(h.sessions))
+	for _, session := range h.sessions {
+		sessions = append(sessions, session)
+	}
+	h.Unlock()
+
+	samples := make([]sessionMetricsSample, 0, len(sessions))
+	for _, session := range sessions {
+		samples = append(samples, session.sampleMetrics())
+	}
+	sort.Slice(samples, func(i, j int) bool {
+		return samples[i].server < samples[j].server
+	})
+
+	var m metricsWriter
+	metrics := []struct {
+		name  string
+		kind  string
+		help  string
+		value func(sample *sessionMetricsSample) interface{}
+	}{
+		{"sneaker_objects", "gauge", "Number of objects tracked by the session.", func(s *sessionMetricsSample) interface{} { return s.objects }},
+		{"sneaker_subscribers", "gauge", "Number of connected subscribers.", func(s *sessionMetricsSample) interface{} { return s.subscribers }},
+		{"sneaker_subscribers_dropped_total", "counter", "Subscribers closed for not keeping up with events.", func(s *sessionMetricsSample) interface{} { return s.droppedSubscribers }},
+		{"sneaker_tacview_reconnects_total", "counter", "Times the Tacview client was reopened after closing.", func(s *sessionMetricsSample) interface{} { return s.reconnects }},
+		{"sneaker_tacview_time_frames_total", "counter", "Time frames received from Tacview.", func(s *sessionMetricsSample) interface{} { return s.timeFrames }},
+		{"sneaker_radar_snapshots_total", "counter", "Radar snapshots encoded for subscribers.", func(s *sessionMetricsSample) interface{} { return s.snapshots }},
+		{"sneaker_radar_snapshot_bytes_total", "counter", "Size of the radar snapshots encoded for subscribers.", func(s *sessionMetricsSample) interface{} { return s.snapshotBytes }},
+	}
+	for _, metric := range metrics {
+		m.describe(metric.name, metric.kind, metric.help)
+		for idx := range samples {
+			m.sample(metric.name, metric.value(&samples[idx]), "server", samples[idx].server)
+		}
+	}
+
+	m.describe("sneaker_tacview_last_error_timestamp_seconds", "gauge", "Time the Tacview client last closed with an error, labeled with the class of error.")
+	for _, sample := range samples {
+		if sample.lastErrorClass == "" {
+			continue
+		}
+		m.sample("sneaker_tacview_last_error_timestamp_seconds", sample.lastErrorAt.Unix(), "server", sample.server, "error", sample.lastErrorClass)
+	}
+
+	if h.discord != nil {
+		h.discord.metrics.Lock()
+		commands := make([]string, 0, len(h.discord.metrics.interactions))
+		for command := range h.discord.metrics.interactions {
+			commands = append(commands, command)
+		}
+		sort.Strings(commands)
+
+		m.describe("sneaker_discord_interactions_total", "counter", "Discord interactions received by command.")
+		for _, command := range commands {
+			m.sample("sneaker_discord_interactions_total", h.discord.metrics.interactions[command], "command", command)
+		}
+		h.discord.metrics.Unlock()
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.WriteHeader(200)
+	w.Write([]byte(m.builder.String()))
+}
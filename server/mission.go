@@ -0,0 +1,126 @@
+package server
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/alioygur/gores"
+)
+
+// Number of missions kept in each servers mission history
+const missionHistoryLength = 20
+
+// Time without a connection to Tacview after which the mission is ended
+const missionEndTimeout = time.Minute * 5
+
+type missionData struct {
+	SessionId string     `json:"session_id"`
+	Title     string     `json:"title"`
+	Briefing  string     `json:"briefing"`
+	Theatre   string     `json:"theatre"`
+	StartedAt time.Time  `json:"started_at"`
+	EndedAt   *time.Time `json:"ended_at"`
+}
+
+// Returns the DCS theatre a mission is played on based on its reference point,
+// using the same bounds as the web UI
+func detectTheatre(coordBase [2]float64) string {
+	lat, lng := coordBase[0], coordBase[1]
+	if lat >= 28 && lat <= 32 && lng >= 29 && lng <= 35 {
+		return "Syria"
+	} else if lat >= 37 && lat <= 41 && lng >= 31 && lng <= 39 {
+		return "Caucasus"
+	} else if lat >= 18 && lat <= 24 && lng >= 48 && lng <= 54 {
+		return "PersianGulf"
+	} else if lat >= 5 && lat <= 14 && lng >= 136 && lng <= 144 {
+		return "Marianas"
+	}
+	return ""
+}
+
+// Builds the mission a newly initialized state is playing, assumes you have a
+// lock on the state
+func newMissionData(state *sessionState) *missionData {
+	return &missionData{
+		SessionId: state.sessionId,
+		Title:     state.globals.Title,
+		Briefing:  state.globals.Briefing,
+		Theatre:   state.globals.Theatre,
+		StartedAt: time.Now(),
+	}
+}
+
+// Ends the current mission if there is one, notifying subscribers
+func (s *serverSession) endMission() {
+	s.Lock()
+	var ended missionData
+	current := s.currentMissionLocked()
+	if current != nil {
+		endedAt := time.Now()
+		current.EndedAt = &endedAt
+		ended = *current
+	}
+	s.Unlock()
+
+	if current != nil {
+		log.Printf("[session:%v] mission %v ended", s.server.Name, ended.SessionId)
+		s.publish("MISSION_ENDED", &ended)
+	}
+}
+
+// Ends the current mission and starts a new one, notifying subscribers. The
+// current mission continues if it has the same session id (e.g. when a looping
+// replay restarts).
+func (s *serverSession) startMission(mission *missionData) {
+	s.Lock()
+	current := s.currentMissionLocked()
+	s.Unlock()
+	if current != nil && current.SessionId == mission.SessionId {
+		return
+	}
+
+	s.endMission()
+
+	s.Lock()
+	s.missions = append(s.missions, mission)
+	if len(s.missions) > missionHistoryLength {
+		s.missions = s.missions[len(s.missions)-missionHistoryLength:]
+	}
+	started := *mission
+	s.Unlock()
+
+	log.Printf("[session:%v] mission %v (%v) started", s.server.Name, started.SessionId, started.Title)
+	s.publish("MISSION_STARTED", &started)
+}
+
+// Returns the mission being played, or nil if there is none. Assumes you have
+// the session lock.
+func (s *serverSession) currentMissionLocked() *missionData {
+	if len(s.missions) == 0 || s.missions[len(s.missions)-1].EndedAt != nil {
+		return nil
+	}
+	return s.missions[len(s.missions)-1]
+}
+
+// Returns a copy of the mission history, oldest first
+func (s *serverSession) getMissions() []missionData {
+	s.Lock()
+	defer s.Unlock()
+
+	result := make([]missionData, 0, len(s.missions))
+	for _, mission := range s.missions {
+		result = append(result, *mission)
+	}
+	return result
+}
+
+// Returns the missions recently played on a server
+func (h *httpServer) getServerMissions(w http.ResponseWriter, r *http.Request) {
+	session := h.ensureSession(w, r)
+	if session == nil {
+		return
+	}
+
+	gores.JSON(w, 200, session.getMissions())
+}
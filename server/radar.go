@@ -0,0 +1,194 @@
+package server
+
+import (
+	"errors"
+	"strings"
+)
+
+// Detection ranges (in nautical miles) of radar equipped units, keyed by their DCS type name
+var unitRadarRanges = map[string]float64{
+	"1L13 EWR":             160,
+	"55G6 EWR":             215,
+	"EWR P-37 BAR LOCK":    160,
+	"FPS-117":              215,
+	"FPS-117 Dome":         215,
+	"RLS_19J6":             80,
+	"p-19 s-125 sr":        85,
+	"SNR_75V":              55,
+	"Kub 1S91 str":         40,
+	"SA-11 Buk SR 9S18M1":  55,
+	"S-300PS 64H6E sr":     80,
+	"S-300PS 40B6MD sr":    40,
+	"Hawk sr":              50,
+	"Patriot str":          85,
+	"NASAMS_Radar_MPQ64F1": 40,
+	"Roland Radar":         20,
+	"Dog Ear radar":        20,
+	"Tor 9A331":            13,
+	"Osa 9A33 ln":          16,
+	"E-3A":                 215,
+	"E-2C":                 160,
+	"A-50":                 160,
+	"KJ-2000":              200,
+}
+
+// Detection range (in nautical miles) used for warships without a known radar
+const defaultNavalRadarRange = 80.0
+
+// Default antenna heights (in meters) for sites and units which don't specify one
+const (
+	defaultSiteAntennaHeight  = 10.0
+	defaultNavalAntennaHeight = 30.0
+)
+
+// Lowest elevation (in meters) accepted for configured radar sites, a little
+// below the lowest point on land
+const minRadarSiteElevation = -500.0
+
+// Checks a configured radar site for values which would silently stop it from
+// detecting anything
+func validateRadarSite(config *RadarSiteConfig) error {
+	coalition, err := parseCoalition(config.Coalition)
+	if err != nil || coalition == "" {
+		return errors.New("coalition must be blue or red")
+	}
+	if config.Latitude < -90 || config.Latitude > 90 || config.Longitude < -180 || config.Longitude > 180 {
+		return errors.New("latitude or longitude is out of range")
+	}
+	if config.Range <= 0 {
+		return errors.New("range must be set to a positive number of nautical miles")
+	}
+	if config.Elevation < minRadarSiteElevation {
+		return errors.New("elevation is below the lowest point on earth")
+	}
+	if config.AntennaHeight < 0 {
+		return errors.New("antenna_height can't be negative")
+	}
+	if config.MinAltitude < 0 {
+		return errors.New("min_altitude can't be negative")
+	}
+	return nil
+}
+
+type radarSite struct {
+	coalition string
+	latitude  float64
+	longitude float64
+
+	// Altitude of the antenna (MSL, in meters)
+	altitude    float64
+	rangeMeters float64
+	minAltitude float64
+}
+
+func newConfiguredRadarSite(config *RadarSiteConfig, terrain *terrainData) *radarSite {
+	antennaHeight := config.AntennaHeight
+	if antennaHeight == 0 {
+		antennaHeight = defaultSiteAntennaHeight
+	}
+
+	elevation := config.Elevation
+	if elevation == 0 && terrain != nil {
+		elevation = terrain.elevation(config.Latitude, config.Longitude)
+	}
+
+	return &radarSite{
+		coalition:   strings.ToLower(config.Coalition),
+		latitude:    config.Latitude,
+		longitude:   config.Longitude,
+		altitude:    elevation + antennaHeight,
+		rangeMeters: config.Range * metersPerNauticalMile,
+		minAltitude: config.MinAltitude,
+	}
+}
+
+// Returns a radar site for an object carrying a radar, or nil if it does not have one
+func newUnitRadarSite(object *StateObject) *radarSite {
+	if object.HasType("Weapon") {
+		return nil
+	}
+
+	radarRange, ok := unitRadarRanges[object.Properties["Name"]]
+	antennaHeight := defaultSiteAntennaHeight
+	if object.HasType("Air") {
+		antennaHeight = 0
+	} else if object.HasType("Sea") && (object.HasType("Warship") || object.HasType("AircraftCarrier")) {
+		antennaHeight = defaultNavalAntennaHeight
+		if !ok {
+			radarRange, ok = defaultNavalRadarRange, true
+		}
+	}
+	if !ok {
+		return nil
+	}
+
+	return &radarSite{
+		coalition:   getObjectCoalition(object),
+		latitude:    object.Latitude,
+		longitude:   object.Longitude,
+		altitude:    object.Altitude + antennaHeight,
+		rangeMeters: radarRange * metersPerNauticalMile,
+	}
+}
+
+// Returns whether the site has line of sight to and can detect the given object.
+// Without terrain data the earth is treated as a smooth sphere.
+func (r *radarSite) detects(object *StateObject, terrain *terrainData) bool {
+	if object.Altitude < r.minAltitude {
+		return false
+	}
+
+	distance := haversineDistance(r.latitude, r.longitude, object.Latitude, object.Longitude)
+	if distance > r.rangeMeters {
+		return false
+	}
+
+	if distance > radarHorizon(r.altitude)+radarHorizon(object.Altitude) {
+		return false
+	}
+
+	if terrain != nil {
+		return terrain.lineOfSight(r.latitude, r.longitude, r.altitude, object.Latitude, object.Longitude, object.Altitude)
+	}
+	return true
+}
+
+// Returns whether radar detection is enabled for the given server
+func radarEnabled(server *TacViewServerConfig) bool {
+	return len(server.RadarSites) > 0 || server.EnableUnitRadars
+}
+
+// Returns whether an object is tracked by radar rather than by proximity to friendly units
+func isRadarTrackable(object *StateObject) bool {
+	if object.HasType("Static") {
+		return false
+	}
+	return object.HasType("Air") || object.HasType("Sea") || object.HasType("Weapon")
+}
+
+// Returns all radar sites belonging to a coalition, assumes you have a lock on the
+// state the objects belong to
+func getRadarSites(server *TacViewServerConfig, terrain *terrainData, coalition string, objects map[uint64]*StateObject) []*radarSite {
+	sites := []*radarSite{}
+	for idx := range server.RadarSites {
+		site := newConfiguredRadarSite(&server.RadarSites[idx], terrain)
+		if site.coalition == coalition {
+			sites = append(sites, site)
+		}
+	}
+
+	if server.EnableUnitRadars {
+		for _, object := range objects {
+			if object.Deleted || getObjectCoalition(object) != coalition {
+				continue
+			}
+
+			site := newUnitRadarSite(object)
+			if site != nil {
+				sites = append(sites, site)
+			}
+		}
+	}
+
+	return sites
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/b1naryth1ef/jambon/tacview"
+)
+
+// Writes the time frames of a single Tacview connection to an ACMI file
+type sessionRecorder struct {
+	path   string
+	file   *os.File
+	zip    *zip.Writer
+	writer *tacview.Writer
+}
+
+// Returns a file name safe version of a server name or session id
+func sanitizeFileName(value string) string {
+	if value == "" {
+		return "unknown"
+	}
+
+	return strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '-' || r == '_' {
+			return r
+		}
+		return '-'
+	}, value)
+}
+
+// Opens a new recording for a session. Each call creates a new file named after the
+// server, session id and the time the recording started so reconnects rotate files.
+func newSessionRecorder(server *TacViewServerConfig, sessionId string, header *tacview.Header) (*sessionRecorder, error) {
+	err := os.MkdirAll(*server.RecordingPath, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+
+	name := fmt.Sprintf(
+		"%s-%s-%s.txt.acmi",
+		sanitizeFileName(server.Name),
+		sanitizeFileName(sessionId),
+		time.Now().UTC().Format("20060102-150405"),
+	)
+
+	path := filepath.Join(*server.RecordingPath, name)
+	if server.CompressRecordings {
+		path = filepath.Join(*server.RecordingPath, strings.TrimSuffix(name, ".txt.acmi")+".zip.acmi")
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	recorder := &sessionRecorder{path: path, file: file}
+
+	var output io.Writer = file
+	if server.CompressRecordings {
+		recorder.zip = zip.NewWriter(file)
+		output, err = recorder.zip.Create(name)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+
+	recorder.writer, err = tacview.NewWriter(output, header)
+	if err != nil {
+		recorder.Close()
+		return nil, err
+	}
+
+	return recorder, nil
+}
+
+func (r *sessionRecorder) writeTimeFrame(tf *tacview.TimeFrame) error {
+	return r.writer.WriteTimeFrame(tf)
+}
+
+// Flushes and closes the recording file
+func (r *sessionRecorder) Close() error {
+	var err error
+	if r.writer != nil {
+		err = r.writer.Close()
+	}
+
+	if r.zip != nil {
+		if zipErr := r.zip.Close(); err == nil {
+			err = zipErr
+		}
+	}
+
+	if fileErr := r.file.Close(); err == nil {
+		err = fileErr
+	}
+	return err
+}
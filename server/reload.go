@@ -0,0 +1,93 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/alioygur/gores"
+)
+
+var errConfigNotReloadable = errors.New("config was not loaded from a file")
+
+// Re-reads the config file and applies its servers: sessions are started for new
+// servers and stopped for removed ones (whose GCIs are taken off-duty), while
+// changes to running servers are applied in place where possible and otherwise
+// restart the session. Other sections of the config are only read on startup.
+func (h *httpServer) reload() error {
+	h.reloadLock.Lock()
+	defer h.reloadLock.Unlock()
+
+	if h.config.path == "" {
+		return errConfigNotReloadable
+	}
+
+	config, err := LoadConfig(h.config.path)
+	if err != nil {
+		return err
+	}
+
+	servers := make(map[string]*TacViewServerConfig, len(config.Servers))
+	for idx := range config.Servers {
+		servers[config.Servers[idx].Name] = &config.Servers[idx]
+	}
+
+	stopped := []*serverSession{}
+	removed := []string{}
+
+	h.Lock()
+	h.config.Servers = config.Servers
+	for name, session := range h.sessions {
+		server, ok := servers[name]
+		if !ok {
+			log.Printf("[reload] server %v was removed", name)
+			removed = append(removed, name)
+		} else if session.canApplyConfig(server) {
+			session.applyConfig(server)
+			continue
+		} else {
+			log.Printf("[reload] server %v changed, restarting its session", name)
+		}
+
+		delete(h.sessions, name)
+		stopped = append(stopped, session)
+	}
+	h.Unlock()
+
+	for _, session := range stopped {
+		session.stop("reload")
+	}
+
+	// Controllers can't stay on-duty on a server which no longer exists
+	for _, name := range removed {
+		for _, gci := range h.gcis.sunsetServer(name) {
+			log.Printf("[reload] %v is no longer on-duty as server %v was removed", gci.Name, name)
+		}
+	}
+
+	for _, server := range config.Servers {
+		_, err := h.getOrCreateSession(server.Name)
+		if err != nil {
+			log.Printf("[reload] failed to start session for server %v: %v", server.Name, err)
+		}
+	}
+
+	log.Printf("[reload] config reloaded with %v servers", len(config.Servers))
+	return nil
+}
+
+// Reloads the config, requires the admin role on every server
+func (h *httpServer) reloadConfig(w http.ResponseWriter, r *http.Request) {
+	if !h.ensureRole(w, r, authAnyServer, roleAdmin) {
+		return
+	}
+
+	err := h.reload()
+	if err != nil {
+		log.Printf("[reload] failed to reload config: %v", err)
+		gores.Error(w, 500, "failed to reload config")
+		return
+	}
+
+	gores.NoContent(w)
+}
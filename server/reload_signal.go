@@ -0,0 +1,27 @@
+//go:build !windows
+// +build !windows
+
+package server
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// Reloads the config whenever the process receives a SIGHUP
+func (h *httpServer) watchReloadSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	go func() {
+		for range signals {
+			log.Printf("[reload] received SIGHUP, reloading config")
+			err := h.reload()
+			if err != nil {
+				log.Printf("[reload] failed to reload config: %v", err)
+			}
+		}
+	}()
+}
@@ -0,0 +1,4 @@
+package server
+
+// Windows has no SIGHUP, the config can only be reloaded through the API
+func (h *httpServer) watchReloadSignal() {}
@@ -0,0 +1,138 @@
+package server
+
+import (
+	"archive/zip"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/b1naryth1ef/jambon/tacview"
+)
+
+// Time waited before a looping replay starts again
+const replayLoopDelay = time.Second * 5
+
+var errEmptyReplay = errors.New("replay contains no time frames")
+
+// Plays back a recorded ACMI file as if it were a realtime Tacview server
+type TacViewReplay struct {
+	config *ReplayConfig
+	err    error
+
+	file      io.Closer
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func NewTacViewReplay(config *ReplayConfig) *TacViewReplay {
+	return &TacViewReplay{config: config, closed: make(chan struct{})}
+}
+
+// Opens the ACMI file, returning a reader for the (possibly compressed) contents
+func openACMIFile(path string) (io.ReadCloser, error) {
+	if !strings.HasSuffix(path, ".zip.acmi") && !strings.HasSuffix(path, ".zip") {
+		return os.Open(path)
+	}
+
+	archive, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(archive.File) == 0 {
+		archive.Close()
+		return nil, errors.New("ACMI archive is empty")
+	}
+
+	file, err := archive.File[0].Open()
+	if err != nil {
+		archive.Close()
+		return nil, err
+	}
+
+	return &acmiArchiveReader{ReadCloser: file, archive: archive}, nil
+}
+
+type acmiArchiveReader struct {
+	io.ReadCloser
+	archive *zip.ReadCloser
+}
+
+func (r *acmiArchiveReader) Close() error {
+	r.ReadCloser.Close()
+	return r.archive.Close()
+}
+
+func (r *TacViewReplay) Start() (*tacview.Header, chan *tacview.TimeFrame, error) {
+	file, err := openACMIFile(r.config.Path)
+	if err != nil {
+		return nil, nil, err
+	}
+	r.file = file
+
+	reader, err := tacview.NewReader(file)
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+
+	speed := r.config.Speed
+	if speed <= 0 {
+		speed = 1
+	}
+
+	frames := make(chan *tacview.TimeFrame, 1)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- reader.ProcessTimeFrames(1, frames)
+	}()
+
+	data := make(chan *tacview.TimeFrame, 1)
+	go func() {
+		defer close(data)
+		defer file.Close()
+
+		var lastOffset float64
+		var started bool
+		for timeFrame := range frames {
+			// Frames before the start offset are sent as fast as possible so the
+			// state at the start offset is complete.
+			if timeFrame.Offset >= r.config.StartOffset {
+				if started {
+					delay := (timeFrame.Offset - lastOffset) / speed
+					select {
+					case <-time.After(time.Duration(delay * float64(time.Second))):
+					case <-r.closed:
+					}
+				}
+				started = true
+				lastOffset = timeFrame.Offset
+			}
+
+			select {
+			case data <- timeFrame:
+			case <-r.closed:
+			}
+		}
+		r.err = <-errs
+	}()
+
+	return &reader.Header, data, nil
+}
+
+func (r *TacViewReplay) Err() error {
+	return r.err
+}
+
+// Closes the recording, which ends the reader
+func (r *TacViewReplay) Close() {
+	r.closeOnce.Do(func() {
+		close(r.closed)
+		if r.file != nil {
+			r.file.Close()
+		}
+	})
+}
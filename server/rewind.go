@@ -0,0 +1,133 @@
+package server
+
+import "math"
+
+// Default number of seconds of past state kept for rewinding
+const defaultRewindDuration = 600
+
+// Offset which resolves to the most recent state in the buffer
+const latestRewindOffset = math.MaxInt64
+
+// A bounded buffer of past radar snapshots which allows reconstructing the
+// complete session state (before any coalition view or ground unit mode is
+// applied) at earlier offsets. Snapshots older than the
+// configured duration are folded into a base state.
+type rewindBuffer struct {
+	duration int64
+
+	baseOffset int64
+	base       map[uint64]*StateObject
+	frames     []*sessionRadarSnapshotData
+}
+
+func newRewindBuffer(duration int64) *rewindBuffer {
+	if duration == 0 {
+		duration = defaultRewindDuration
+	}
+
+	return &rewindBuffer{duration: duration, base: make(map[uint64]*StateObject)}
+}
+
+// Returns a copy of a snapshot which is unaffected by further state updates
+func copySnapshot(data *sessionRadarSnapshotData) *sessionRadarSnapshotData {
+	result := &sessionRadarSnapshotData{
+		Offset:  data.Offset,
+		Created: make([]*StateObject, len(data.Created)),
+		Updated: make([]*StateObject, len(data.Updated)),
+		Deleted: append([]uint64{}, data.Deleted...),
+	}
+
+	for idx, object := range data.Created {
+		result.Created[idx] = object.copy()
+	}
+	for idx, object := range data.Updated {
+		result.Updated[idx] = object.copy()
+	}
+	return result
+}
+
+// Applies a snapshot to a set of objects. Objects within snapshots are never
+// modified so they can be shared between object sets.
+func applySnapshot(objects map[uint64]*StateObject, data *sessionRadarSnapshotData) {
+	for _, object := range data.Created {
+		objects[object.Id] = object
+	}
+	for _, object := range data.Updated {
+		objects[object.Id] = object
+	}
+	for _, objectId := range data.Deleted {
+		delete(objects, objectId)
+	}
+}
+
+// Clears the buffer, starting again from the given copies of objects
+func (b *rewindBuffer) reset(objects []*StateObject, offset int64) {
+	b.baseOffset = offset
+	b.base = make(map[uint64]*StateObject, len(objects))
+	b.frames = nil
+	for _, object := range objects {
+		b.base[object.Id] = object
+	}
+}
+
+// Adds a copied snapshot to the buffer, trimming any which are now too old
+func (b *rewindBuffer) push(data *sessionRadarSnapshotData) {
+	b.frames = append(b.frames, data)
+
+	trim := 0
+	for trim < len(b.frames) && b.frames[trim].Offset < data.Offset-b.duration {
+		applySnapshot(b.base, b.frames[trim])
+		b.baseOffset = b.frames[trim].Offset
+		trim += 1
+	}
+	b.frames = b.frames[trim:]
+}
+
+// Returns the offset of the most recent state in the buffer
+func (b *rewindBuffer) latestOffset() int64 {
+	if len(b.frames) == 0 {
+		return b.baseOffset
+	}
+	return b.frames[len(b.frames)-1].Offset
+}
+
+// Resolves a requested offset, negative offsets are relative to the latest state
+// and offsets older than the buffer are clamped to the oldest available state
+func (b *rewindBuffer) resolveOffset(offset int64) int64 {
+	if offset < 0 {
+		offset = b.latestOffset() + offset
+	}
+	if offset < b.baseOffset {
+		offset = b.baseOffset
+	}
+	return offset
+}
+
+// Returns the objects as they were at the most recent snapshot at or before the
+// given (resolved) offset, along with the offset of that snapshot
+func (b *rewindBuffer) objectsAt(offset int64) (map[uint64]*StateObject, int64) {
+	objects := make(map[uint64]*StateObject, len(b.base))
+	for id, object := range b.base {
+		objects[id] = object
+	}
+
+	actualOffset := b.baseOffset
+	for _, frame := range b.frames {
+		if frame.Offset > offset {
+			break
+		}
+		applySnapshot(objects, frame)
+		actualOffset = frame.Offset
+	}
+	return objects, actualOffset
+}
+
+// Returns all snapshots after the given offset
+func (b *rewindBuffer) framesAfter(offset int64) []*sessionRadarSnapshotData {
+	for idx, frame := range b.frames {
+		if frame.Offset > offset {
+			return append([]*sessionRadarSnapshotData{}, b.frames[idx:]...)
+		}
+	}
+	return nil
+}
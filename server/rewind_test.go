@@ -0,0 +1,137 @@
+package server
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func rewindTestObject(id uint64, latitude float64) *StateObject {
+	return &StateObject{Id: id, Properties: map[string]string{}, Latitude: latitude}
+}
+
+// Builds a buffer starting at offset 0 with object 1, which moves north by one
+// degree every 5 seconds. Object 2 is created at 10 and deleted at 20.
+func newRewindTestBuffer(duration int64, until int64) *rewindBuffer {
+	buffer := newRewindBuffer(duration)
+	buffer.reset([]*StateObject{rewindTestObject(1, 0)}, 0)
+
+	for offset := int64(5); offset <= until; offset += 5 {
+		data := &sessionRadarSnapshotData{
+			Offset:  offset,
+			Created: []*StateObject{},
+			Updated: []*StateObject{rewindTestObject(1, float64(offset/5))},
+			Deleted: []uint64{},
+		}
+		if offset == 10 {
+			data.Created = append(data.Created, rewindTestObject(2, 0))
+		} else if offset == 20 {
+			data.Deleted = append(data.Deleted, 2)
+		}
+		buffer.push(copySnapshot(data))
+	}
+	return buffer
+}
+
+func TestRewindBufferTrimsOldSnapshots(t *testing.T) {
+	cases := []struct {
+		until          int64
+		baseOffset     int64
+		frames         []int64
+		baseLatitude   float64
+		baseHasObject2 bool
+	}{
+		{until: 10, baseOffset: 0, frames: []int64{5, 10}, baseLatitude: 0},
+		// Snapshots exactly the duration old are kept
+		{until: 20, baseOffset: 0, frames: []int64{5, 10, 15, 20}, baseLatitude: 0},
+		{until: 25, baseOffset: 5, frames: []int64{10, 15, 20, 25}, baseLatitude: 1},
+		{until: 35, baseOffset: 15, frames: []int64{20, 25, 30, 35}, baseLatitude: 3, baseHasObject2: true},
+		{until: 40, baseOffset: 20, frames: []int64{25, 30, 35, 40}, baseLatitude: 4},
+	}
+
+	for _, c := range cases {
+		buffer := newRewindTestBuffer(15, c.until)
+
+		frames := []int64{}
+		for _, frame := range buffer.frames {
+			frames = append(frames, frame.Offset)
+		}
+		if buffer.baseOffset != c.baseOffset || !reflect.DeepEqual(frames, c.frames) {
+			t.Errorf("until %v: expected base %v and frames %v, got %v and %v", c.until, c.baseOffset, c.frames, buffer.baseOffset, frames)
+		}
+		if buffer.base[1].Latitude != c.baseLatitude {
+			t.Errorf("until %v: expected a base latitude of %v, got %v", c.until, c.baseLatitude, buffer.base[1].Latitude)
+		}
+		if _, ok := buffer.base[2]; ok != c.baseHasObject2 {
+			t.Errorf("until %v: expected object 2 in the base to be %v", c.until, c.baseHasObject2)
+		}
+		if buffer.latestOffset() != c.until {
+			t.Errorf("until %v: expected the latest offset to be %v, got %v", c.until, c.until, buffer.latestOffset())
+		}
+	}
+}
+
+func TestRewindBufferObjectsAt(t *testing.T) {
+	buffer := newRewindTestBuffer(15, 35)
+
+	cases := []struct {
+		requested int64
+		offset    int64
+		latitude  float64
+		ids       []uint64
+	}{
+		// Older than the buffer, clamped to the base
+		{requested: 0, offset: 15, latitude: 3, ids: []uint64{1, 2}},
+		{requested: -100, offset: 15, latitude: 3, ids: []uint64{1, 2}},
+		// Between snapshots, seeks back to the earlier one
+		{requested: 22, offset: 20, latitude: 4, ids: []uint64{1}},
+		{requested: 27, offset: 25, latitude: 5, ids: []uint64{1}},
+		{requested: -5, offset: 30, latitude: 6, ids: []uint64{1}},
+		{requested: 35, offset: 35, latitude: 7, ids: []uint64{1}},
+		{requested: latestRewindOffset, offset: 35, latitude: 7, ids: []uint64{1}},
+	}
+
+	for _, c := range cases {
+		objects, offset := buffer.objectsAt(buffer.resolveOffset(c.requested))
+		ids := []uint64{}
+		for id := range objects {
+			ids = append(ids, id)
+		}
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+		if offset != c.offset || objects[1].Latitude != c.latitude || !reflect.DeepEqual(ids, c.ids) {
+			t.Errorf("offset %v: expected %v at %v with %v, got %v at %v with %v",
+				c.requested, c.ids, c.offset, c.latitude, ids, offset, objects[1].Latitude)
+		}
+	}
+}
+
+func TestRewindBufferSeeksWithinFrames(t *testing.T) {
+	buffer := newRewindTestBuffer(100, 20)
+
+	objects, offset := buffer.objectsAt(buffer.resolveOffset(12))
+	if offset != 10 || objects[2] == nil {
+		t.Errorf("expected object 2 to exist at offset 10, got %v at %v", objects, offset)
+	}
+
+	objects, offset = buffer.objectsAt(buffer.resolveOffset(20))
+	if offset != 20 || objects[2] != nil {
+		t.Errorf("expected object 2 to be deleted at offset 20, got %v at %v", objects, offset)
+	}
+
+	// The base is never modified by seeking
+	if len(buffer.base) != 1 || buffer.base[1].Latitude != 0 {
+		t.Errorf("expected the base to be unchanged, got %v", buffer.base)
+	}
+
+	frames := []int64{}
+	for _, frame := range buffer.framesAfter(10) {
+		frames = append(frames, frame.Offset)
+	}
+	if !reflect.DeepEqual(frames, []int64{15, 20}) {
+		t.Errorf("expected the frames after 10 to be [15 20], got %v", frames)
+	}
+	if buffer.framesAfter(20) != nil {
+		t.Errorf("expected no frames after the latest")
+	}
+}
@@ -0,0 +1,220 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"math"
+	"strconv"
+	"time"
+)
+
+// Interval between steps of a simulated antenna sweep
+const sweepStepInterval = time.Millisecond * 250
+
+// Bounds of the refresh rate (in seconds) subscribers may request
+const (
+	minSubscriberRefreshRate = 1
+	maxSubscriberRefreshRate = 60
+)
+
+var errInvalidRefreshRate = errors.New("invalid refresh rate")
+
+// Default number of subscribers with their own refresh rate or sweep each server accepts
+const defaultMaxScopedSubscribers = 32
+
+var errTooManyScopedSubscribers = errors.New("too many subscribers with a refresh rate or sweep")
+
+// Parses a requested refresh rate in seconds, an empty value uses the servers rate
+func parseRefreshRate(value string) (int64, error) {
+	if value == "" {
+		return 0, nil
+	}
+
+	rate, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || rate < minSubscriberRefreshRate || rate > maxSubscriberRefreshRate {
+		return 0, errInvalidRefreshRate
+	}
+	return rate, nil
+}
+
+// Builds radar snapshots for a single subscriber at its own refresh rate, or as a
+// simulated antenna sweeps past objects. Only used by the subscribers scope loop
+// except for reset which is protected by the session lock.
+type subscriberScope struct {
+	options  subscriberOptions
+	view     *coalitionView
+	history  bool
+	interval time.Duration
+
+	// Copies of the objects as they were last sent to the subscriber
+	sent map[uint64]*StateObject
+
+	// Antenna origin, current azimuth and how far it turns (in degrees) each step
+	origin    *SweepOriginConfig
+	azimuth   float64
+	sweepStep float64
+
+	// Set when the session is reinitialized and the subscriber has been sent a
+	// new SESSION_STATE
+	reset bool
+}
+
+// Creates a scope for a subscriber, assumes you have a lock on the state the
+// server config belongs to
+func newSubscriberScope(server *TacViewServerConfig, view *coalitionView, options subscriberOptions) *subscriberScope {
+	scope := &subscriberScope{
+		options:  options,
+		view:     view,
+		history:  server.SendTrackHistory,
+		interval: refreshRate(server, options.refreshRate),
+		sent:     make(map[uint64]*StateObject),
+	}
+
+	if options.sweep {
+		scope.origin = server.SweepOrigin
+		scope.sweepStep = 360 * float64(sweepStepInterval) / float64(scope.interval)
+		scope.interval = sweepStepInterval
+	}
+	return scope
+}
+
+// Returns whether the antenna passes over the given object during the current step
+func (sc *subscriberScope) swept(object *StateObject) bool {
+	if sc.origin == nil {
+		return true
+	}
+
+	bearing := initialBearing(sc.origin.Latitude, sc.origin.Longitude, object.Latitude, object.Longitude)
+	return math.Mod(bearing-sc.azimuth+360, 360) < sc.sweepStep
+}
+
+// Replaces the objects the subscriber is known to have, assumes you have a lock
+// on the state the objects belong to
+func (sc *subscriberScope) seed(objects []*StateObject) {
+	sc.sent = make(map[uint64]*StateObject, len(objects))
+	for _, object := range objects {
+		sc.sent[object.Id] = object.copy()
+	}
+}
+
+// Builds the next radar snapshot for this subscriber, returning nil if it would
+// be empty in sweep mode. Detection is expensive, so rather than running it for
+// every subscriber this uses the visibility the session computed for its
+// coalition view at the last radar refresh. Assumes you have a lock on the state
+// the objects belong to.
+func (sc *subscriberScope) snapshot(objects map[uint64]*StateObject, offset int64) interface{} {
+	visible := make(map[uint64]bool, len(sc.view.visible))
+	for id := range sc.view.visible {
+		if object, ok := objects[id]; ok && !object.Deleted {
+			visible[id] = true
+		}
+	}
+
+	data := &sessionRadarSnapshotData{
+		Offset:  offset,
+		Created: make([]*StateObject, 0),
+		Updated: make([]*StateObject, 0),
+		Deleted: make([]uint64, 0),
+	}
+	deltas := make([]*StateObjectDelta, 0)
+
+	for id := range visible {
+		object := objects[id]
+		if !sc.swept(object) {
+			continue
+		}
+
+		previous, ok := sc.sent[id]
+		if ok && object.UpdatedAt <= previous.UpdatedAt {
+			continue
+		}
+
+		current := object.copy()
+		if !ok {
+			if sc.history && sc.view.canSeeHistory(object) {
+				data.Created = append(data.Created, object.withHistory())
+			} else {
+				data.Created = append(data.Created, current)
+			}
+		} else {
+			data.Updated = append(data.Updated, current)
+			deltas = append(deltas, current.diff(previous))
+		}
+		sc.sent[id] = current
+	}
+
+	// Objects are removed from the scope when the antenna passes their last
+	// known position
+	for id, previous := range sc.sent {
+		if visible[id] || !sc.swept(previous) {
+			continue
+		}
+		data.Deleted = append(data.Deleted, id)
+		delete(sc.sent, id)
+	}
+
+	if sc.origin != nil {
+		sc.azimuth = math.Mod(sc.azimuth+sc.sweepStep, 360)
+		if len(data.Created) == 0 && len(data.Updated) == 0 && len(data.Deleted) == 0 {
+			return nil
+		}
+	}
+
+	if sc.options.deltas {
+		return &sessionRadarDeltaSnapshotData{
+			Offset:  data.Offset,
+			Created: data.Created,
+			Updated: deltas,
+			Deleted: data.Deleted,
+		}
+	}
+	return data
+}
+
+// Sends radar snapshots to a scoped subscriber until it is removed
+func (s *serverSession) scopeLoop(id int, scope *subscriberScope) {
+	ticker := time.NewTicker(scope.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.ctx.Done():
+			return
+		}
+
+		s.Lock()
+		sub, ok := s.subscribers[id]
+		reset := ok && sub.scope.reset
+		if reset {
+			sub.scope.reset = false
+		}
+		s.Unlock()
+		if !ok {
+			return
+		}
+
+		s.state.RLock()
+		if !s.state.active {
+			s.state.RUnlock()
+			continue
+		}
+
+		var data interface{}
+		if reset {
+			scope.seed(scope.view.objects(s.state.objects))
+		} else {
+			data = scope.snapshot(s.state.objects, s.state.offset)
+		}
+		s.state.RUnlock()
+
+		if data == nil {
+			continue
+		}
+
+		err := s.sendTo(id, "SESSION_RADAR_SNAPSHOT", data)
+		if err != nil {
+			log.Printf("[session:%v] failed to send radar snapshot to subscriber %v: %v", s.server.Name, id, err)
+		}
+	}
+}
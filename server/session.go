@@ -1,11 +1,16 @@
 package server
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"log"
+	"reflect"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/b1naryth1ef/jambon/tacview"
 )
 
 type sessionRadarSnapshotData struct {
@@ -15,24 +20,157 @@ type sessionRadarSnapshotData struct {
 	Deleted []uint64       `json:"deleted"`
 }
 
+// A radar snapshot sent to subscribers which requested deltas, updated objects
+// only contain the fields which changed since the previous snapshot
+type sessionRadarDeltaSnapshotData struct {
+	Offset  int64               `json:"offset"`
+	Created []*StateObject      `json:"created"`
+	Updated []*StateObjectDelta `json:"updated"`
+	Deleted []uint64            `json:"deleted"`
+}
+
+// Returns the delta form of a snapshot, assumes the objects it contains are not
+// being updated concurrently
+func (data *sessionRadarSnapshotData) toDeltas() *sessionRadarDeltaSnapshotData {
+	result := &sessionRadarDeltaSnapshotData{
+		Offset:  data.Offset,
+		Created: data.Created,
+		Updated: make([]*StateObjectDelta, len(data.Updated)),
+		Deleted: data.Deleted,
+	}
+	for idx, object := range data.Updated {
+		result.Updated[idx] = object.getDelta()
+	}
+	return result
+}
+
 type sessionStateData struct {
-	SessionId string         `json:"session_id"`
-	Offset    int64          `json:"offset"`
-	Objects   []*StateObject `json:"objects"`
+	SessionId string          `json:"session_id"`
+	Offset    int64           `json:"offset"`
+	Objects   []*StateObject  `json:"objects"`
+	Globals   *SessionGlobals `json:"globals"`
+}
+
+// Default number of track history points kept for each object
+const defaultTrackHistoryLength = 30
+
+// Default radar refresh rate in seconds
+const defaultRadarRefreshRate = 5
+
+// Returns the radar refresh rate for a server, or the requested rate if set
+func refreshRate(server *TacViewServerConfig, requested int64) time.Duration {
+	if requested != 0 {
+		return time.Second * time.Duration(requested)
+	}
+	if server.RadarRefreshRate != 0 {
+		return time.Second * time.Duration(server.RadarRefreshRate)
+	}
+	return time.Second * defaultRadarRefreshRate
+}
+
+// Options chosen by a client when subscribing to a session
+type subscriberOptions struct {
+	// The coalition view this subscriber receives, empty for the unfiltered view
+	coalition string
+	format    string
+
+	// Whether updated objects in radar snapshots are sent as deltas
+	deltas bool
+
+	// Radar refresh rate (in seconds) requested by the subscriber, zero uses the
+	// servers rate. In sweep mode this is the time taken for a full rotation.
+	refreshRate int64
+	sweep       bool
+}
+
+// Returns whether the subscriber needs its own scope rather than receiving the
+// sessions radar snapshots
+func (o subscriberOptions) scoped() bool {
+	return o.refreshRate != 0 || o.sweep
+}
+
+type sessionSubscriber struct {
+	subscriberOptions
+	events chan<- sessionEvent
+	scope  *subscriberScope
+
+	// Radar snapshots at or before this offset have already been sent to the
+	// subscriber while catching up from the rewind buffer
+	since int64
 }
 
 type serverSession struct {
 	sync.Mutex
 
+	// The servers config, fields which can be changed by reloading the config
+	// are protected by the state lock
 	server *TacViewServerConfig
 
+	// Cancelled when the session is stopped
+	ctx     context.Context
+	cancel  context.CancelFunc
+	stopped bool
+
 	subscriberIdx int
-	subscribers   map[int]chan<- []byte
+	subscribers   map[int]*sessionSubscriber
 	state         sessionState
+
+	// Per-coalition views of the state, protected by the state lock
+	views   map[string]*coalitionView
+	terrain *terrainData
+
+	// Past snapshots used for rewinding, protected by the session lock
+	rewind *rewindBuffer
+
+	// View of every object the rewind snapshots are built from, protected by the
+	// state lock
+	recordingView *coalitionView
+
+	metrics *sessionMetrics
+
+	// Status of the connection to Tacview, protected by the session lock
+	upstream       string
+	connectedAt    time.Time
+	lastError      string
+	lastErrorClass string
+	lastErrorAt    time.Time
+
+	// Recently played missions, protected by the session lock
+	missions []*missionData
 }
 
-func newServerSession(server *TacViewServerConfig) (*serverSession, error) {
-	return &serverSession{server: server, subscribers: make(map[int]chan<- []byte)}, nil
+func newServerSession(ctx context.Context, server *TacViewServerConfig) (*serverSession, error) {
+	var terrain *terrainData
+	if server.TerrainPath != nil {
+		terrain = newTerrainData(*server.TerrainPath)
+
+		// Radar sites read their elevation from the terrain when it isn't configured
+		for _, site := range server.RadarSites {
+			if site.Elevation == 0 {
+				terrain.preload(site.Latitude, site.Longitude)
+			}
+		}
+	}
+
+	views := map[string]*coalitionView{"": newCoalitionView(server, terrain, "")}
+	for _, coalition := range viewCoalitions {
+		views[coalition] = newCoalitionView(server, terrain, coalition)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	return &serverSession{
+		server: server,
+		ctx:    ctx,
+		cancel: cancel,
+
+		subscribers:   make(map[int]*sessionSubscriber),
+		views:         views,
+		terrain:       terrain,
+		rewind:        newRewindBuffer(server.RewindDuration),
+		recordingView: newRecordingView(server),
+		metrics:       &sessionMetrics{},
+		upstream:      upstreamConnecting,
+	}, nil
 }
 
 type PlayerMetadata struct {
@@ -40,10 +178,16 @@ type PlayerMetadata struct {
 	Type string `json:"type"`
 }
 
-func (s *serverSession) GetPlayerList() []PlayerMetadata {
+// Returns the players flying on the server, only including those of the given
+// coalition unless it is empty
+func (s *serverSession) GetPlayerList(coalition string) []PlayerMetadata {
 	players := []PlayerMetadata{}
 	s.state.RLock()
 	for _, object := range s.state.objects {
+		if coalition != "" && getObjectCoalition(object) != coalition {
+			continue
+		}
+
 		isPlayer := false
 
 		for _, typeName := range object.Types {
@@ -75,51 +219,70 @@ func (s *serverSession) GetPlayerList() []PlayerMetadata {
 }
 
 func (s *serverSession) updateLoop() {
-	refreshRate := time.Duration(5)
-	if s.server.RadarRefreshRate != 0 {
-		refreshRate = time.Duration(s.server.RadarRefreshRate)
-	}
-	ticker := time.NewTicker(time.Second * refreshRate)
+	s.state.RLock()
+	interval := refreshRate(s.server, 0)
+	s.state.RUnlock()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
 
 	var currentOffset int64
 	for {
-		<-ticker.C
+		select {
+		case <-ticker.C:
+		case <-s.ctx.Done():
+			return
+		}
 
 		if !s.state.active {
 			continue
 		}
 
 		s.state.Lock()
-		data := &sessionRadarSnapshotData{
-			Offset:  s.state.offset,
-			Created: make([]*StateObject, 0),
-			Updated: make([]*StateObject, 0),
-			Deleted: make([]uint64, 0),
+		// The refresh rate may have been changed by reloading the config
+		if rate := refreshRate(s.server, 0); rate != interval {
+			interval = rate
+			ticker.Reset(interval)
 		}
 
-		for _, object := range s.state.objects {
-			if object.Deleted {
-				data.Deleted = append(data.Deleted, object.Id)
-			} else if object.CreatedAt > currentOffset {
-				data.Created = append(data.Created, object)
-			} else if object.UpdatedAt > currentOffset {
-				data.Updated = append(data.Updated, object)
+		s.state.expireVelocities()
+		s.state.recordHistory(s.trackHistoryLength())
+		s.state.takeDeltas(currentOffset)
+
+		snapshots := make(map[string]*sessionRadarSnapshotData, len(s.views))
+		deltas := make(map[string]*sessionRadarDeltaSnapshotData, len(s.views))
+		for coalition, view := range s.views {
+			snapshots[coalition] = view.snapshot(s.state.objects, s.state.offset, currentOffset)
+			if s.server.SendTrackHistory {
+				snapshots[coalition].Created = view.attachHistory(snapshots[coalition].Created)
 			}
+			deltas[coalition] = snapshots[coalition].toDeltas()
 		}
 
 		// We can now delete these objects from the state
-		for _, objectId := range data.Deleted {
-			delete(s.state.objects, objectId)
+		for objectId, object := range s.state.objects {
+			if object.Deleted {
+				delete(s.state.objects, objectId)
+			}
 		}
 
+		rewindFrame := copySnapshot(s.recordingView.snapshot(s.state.objects, s.state.offset, currentOffset))
 		currentOffset = s.state.offset
 		s.state.Unlock()
 
-		s.publish("SESSION_RADAR_SNAPSHOT", data)
+		// The snapshot must be in the rewind buffer before it is published so
+		// rewinding subscribers never miss a snapshot
+		s.Lock()
+		s.rewind.push(rewindFrame)
+		s.Unlock()
+
+		for coalition, data := range snapshots {
+			s.publishSnapshot(coalition, data, deltas[coalition])
+		}
 	}
 }
 
-func (s *serverSession) getInitialState() (*sessionStateData, []*StateObject) {
+func (s *serverSession) getInitialState(coalition string) (*sessionStateData, []*StateObject) {
 	s.state.RLock()
 	defer s.state.RUnlock()
 
@@ -127,91 +290,523 @@ func (s *serverSession) getInitialState() (*sessionStateData, []*StateObject) {
 		return nil, nil
 	}
 
-	objects := make([]*StateObject, len(s.state.objects))
-
-	idx := 0
-	for _, object := range s.state.objects {
-		objects[idx] = object
-		idx += 1
+	view := s.views[coalition]
+	objects := view.objects(s.state.objects)
+	if s.server.SendTrackHistory {
+		objects = view.attachHistory(objects)
 	}
 
 	return &sessionStateData{
 		SessionId: s.state.sessionId,
 		Offset:    s.state.offset,
+		Globals:   s.state.getGlobals(objects),
 	}, objects
 }
 
+// Returns the globals of the mission being played, or nil if there is none.
+// Bullseyes are left out on servers with fog of war.
+func (s *serverSession) getGlobals() *SessionGlobals {
+	s.state.RLock()
+	defer s.state.RUnlock()
+
+	if !s.state.active {
+		return nil
+	}
+
+	var objects []*StateObject
+	if !s.server.EnableFogOfWar {
+		objects = s.views[""].objects(s.state.objects)
+	}
+	return s.state.getGlobals(objects)
+}
+
+var errObjectNotFound = errors.New("no object by that id was found")
+
+// Returns the track history of an object as seen by the given coalition view
+func (s *serverSession) getObjectHistory(coalition string, objectId uint64) ([]StateHistoryPoint, error) {
+	s.state.RLock()
+	defer s.state.RUnlock()
+
+	view := s.views[coalition]
+	object, ok := s.state.objects[objectId]
+	if !ok || object.Deleted || !view.visible[objectId] || !view.canSeeHistory(object) {
+		return nil, errObjectNotFound
+	}
+	return object.getHistory(), nil
+}
+
+func (s *serverSession) trackHistoryLength() int {
+	if s.server.TrackHistoryLength != 0 {
+		return s.server.TrackHistoryLength
+	}
+	return defaultTrackHistoryLength
+}
+
+// Returns the state of a coalition view at an earlier offset, negative offsets
+// are relative to the most recent snapshot
+func (s *serverSession) getRewindState(coalition string, offset int64) *sessionStateData {
+	s.Lock()
+	defer s.Unlock()
+	return s.rewindView(coalition, offset, nil)
+}
+
+// Adds a subscriber which starts from an earlier offset, returning the state at
+// that offset and the snapshots between it and the present
+func (s *serverSession) addRewindSub(options subscriberOptions, offset int64) (<-chan sessionEvent, func(), *sessionStateData, []*sessionRadarSnapshotData) {
+	s.Lock()
+	defer s.Unlock()
+
+	snapshots := []*sessionRadarSnapshotData{}
+	state := s.rewindView(options.coalition, offset, &snapshots)
+
+	since := state.Offset
+	if len(snapshots) > 0 {
+		since = snapshots[len(snapshots)-1].Offset
+	}
+
+	sub, closer := s.addSubLocked(options, since, nil)
+	return sub, closer, state, snapshots
+}
+
+// Reconstructs a coalition view from the rewind buffer, optionally collecting the
+// view's snapshots from the offset onwards. The buffer holds every object, so
+// detection and the ground unit modes are applied as they would be live.
+// Assumes you have the session lock.
+func (s *serverSession) rewindView(coalition string, offset int64, snapshots *[]*sessionRadarSnapshotData) *sessionStateData {
+	objects, actualOffset := s.rewind.objectsAt(s.rewind.resolveOffset(offset))
+
+	s.state.RLock()
+	defer s.state.RUnlock()
+
+	view := newCoalitionView(s.server, s.terrain, coalition)
+	state := &sessionStateData{
+		SessionId: s.state.sessionId,
+		Offset:    actualOffset,
+		Objects:   view.reset(objects),
+	}
+	state.Globals = s.state.getGlobals(state.Objects)
+
+	if snapshots != nil {
+		since := actualOffset
+		for _, frame := range s.rewind.framesAfter(actualOffset) {
+			applySnapshot(objects, frame)
+			*snapshots = append(*snapshots, view.snapshot(objects, frame.Offset, since))
+			since = frame.Offset
+		}
+	}
+
+	return state
+}
+
+// Publishes an event to every subscriber regardless of their coalition view
 func (s *serverSession) publish(event string, data interface{}) error {
-	encoded, err := json.Marshal(map[string]interface{}{
-		"e": event,
-		"d": data,
+	return s.broadcast(event, data, func(sub *sessionSubscriber) bool {
+		return true
+	})
+}
+
+// Publishes an event only to subscribers of the given coalition view
+func (s *serverSession) publishTo(coalition string, event string, data interface{}) error {
+	return s.broadcast(event, data, func(sub *sessionSubscriber) bool {
+		return sub.coalition == coalition
+	})
+}
+
+// Publishes a radar snapshot to subscribers of the given coalition view which
+// have not already received it
+func (s *serverSession) publishSnapshot(coalition string, data *sessionRadarSnapshotData, deltas *sessionRadarDeltaSnapshotData) error {
+	err := s.broadcast("SESSION_RADAR_SNAPSHOT", data, func(sub *sessionSubscriber) bool {
+		return sub.scope == nil && sub.coalition == coalition && !sub.deltas && data.Offset > sub.since
 	})
 	if err != nil {
 		return err
 	}
 
+	return s.broadcast("SESSION_RADAR_SNAPSHOT", deltas, func(sub *sessionSubscriber) bool {
+		return sub.scope == nil && sub.coalition == coalition && sub.deltas && data.Offset > sub.since
+	})
+}
+
+// Sends an event to the matching subscribers, the event is encoded at most once
+// for each format the subscribers use
+func (s *serverSession) broadcast(event string, data interface{}, filter func(*sessionSubscriber) bool) error {
+	encoded := make(map[string]sessionEvent, 1)
+
 	s.Lock()
+	defer s.Unlock()
 	for id, sub := range s.subscribers {
-		select {
-		case sub <- encoded:
+		if !filter(sub) {
 			continue
-		default:
-			log.Printf("[session:%v] subscriber %v non-responsive, closing", s.server.Name, id)
-			delete(s.subscribers, id)
-			close(sub)
 		}
+
+		msg, ok := encoded[sub.format]
+		if !ok {
+			var err error
+			msg, err = encodeEvent(sub.format, event, data)
+			if err != nil {
+				return err
+			}
+			encoded[sub.format] = msg
+
+			if event == "SESSION_RADAR_SNAPSHOT" {
+				atomic.AddInt64(&s.metrics.snapshots, 1)
+				atomic.AddInt64(&s.metrics.snapshotBytes, int64(len(msg.encoded)))
+			}
+		}
+
+		s.deliverLocked(id, sub, msg)
+	}
+	return nil
+}
+
+// Sends an event to a single subscriber, returning errSubscriberClosed if it no
+// longer exists
+func (s *serverSession) sendTo(id int, event string, data interface{}) error {
+	s.Lock()
+	defer s.Unlock()
+
+	sub, ok := s.subscribers[id]
+	if !ok {
+		return errSubscriberClosed
+	}
+
+	msg, err := encodeEvent(sub.format, event, data)
+	if err != nil {
+		return err
+	}
+
+	if !s.deliverLocked(id, sub, msg) {
+		return errSubscriberClosed
 	}
-	s.Unlock()
 	return nil
+}
 
+var errSubscriberClosed = errors.New("subscriber closed")
+
+// Queues an event for a subscriber, closing it if it is not keeping up. Assumes
+// you have the session lock.
+func (s *serverSession) deliverLocked(id int, sub *sessionSubscriber, msg sessionEvent) bool {
+	select {
+	case sub.events <- msg:
+		return true
+	default:
+		log.Printf("[session:%v] subscriber %v non-responsive, closing", s.server.Name, id)
+		atomic.AddInt64(&s.metrics.droppedSubscribers, 1)
+		delete(s.subscribers, id)
+		close(sub.events)
+		return false
+	}
 }
 
 func (s *serverSession) run() {
 	go s.updateLoop()
 
+	endpoints := tacViewEndpoints(s.server)
+	endpoint := 0
+	attempt := 0
+	var disconnectedAt time.Time
 	for {
-		err := s.runTacViewClient()
-		log.Printf("[session:%v] tacview client closed, reseting and reopening in 5 seconds (%v)", s.server.Name, err)
-		time.Sleep(time.Second * 5)
+		connected, err := s.runTacViewClient(endpoints[endpoint])
+
+		// The session was stopped by a reload or shutdown
+		if s.ctx.Err() != nil {
+			return
+		}
+
+		if s.server.Replay != nil && err == nil {
+			if !s.server.Replay.Loop {
+				log.Printf("[session:%v] replay finished", s.server.Name)
+				s.endMission()
+				return
+			}
+
+			log.Printf("[session:%v] replay finished, restarting in %v", s.server.Name, replayLoopDelay)
+			select {
+			case <-time.After(replayLoopDelay):
+			case <-s.ctx.Done():
+				return
+			}
+			continue
+		}
+
+		// Back off while connection attempts keep failing, failing over to the
+		// next endpoint each time
+		if connected {
+			attempt = 0
+			disconnectedAt = time.Now()
+		} else {
+			endpoint = (endpoint + 1) % len(endpoints)
+		}
+		delay := reconnectDelay(s.server.Reconnect, attempt)
+		attempt++
+
+		if !disconnectedAt.IsZero() && time.Since(disconnectedAt) >= missionEndTimeout {
+			s.endMission()
+		}
+
+		log.Printf(
+			"[session:%v] tacview client closed, reseting and reopening %v:%v in %v (%v)",
+			s.server.Name,
+			endpoints[endpoint].Hostname,
+			endpoints[endpoint].Port,
+			delay.Round(time.Millisecond),
+			err,
+		)
+		s.setUpstream(upstreamDisconnected, err)
+		atomic.AddInt64(&s.metrics.reconnects, 1)
+		select {
+		case <-time.After(delay):
+		case <-s.ctx.Done():
+			return
+		}
 	}
 }
 
-func (s *serverSession) runTacViewClient() error {
-	client := NewTacViewClient(s.server.Hostname, s.server.Port, s.server.Password)
+type sessionClosedData struct {
+	Reason string `json:"reason"`
+}
+
+// Stops the session, ending the current mission and sending every subscriber a
+// final SESSION_CLOSED event with the given reason before closing it
+func (s *serverSession) stop(reason string) {
+	s.Lock()
+	if s.stopped {
+		s.Unlock()
+		return
+	}
+	s.stopped = true
+	s.cancel()
+	s.Unlock()
+
+	s.endMission()
+
+	s.Lock()
+	defer s.Unlock()
+
+	encoded := make(map[string]sessionEvent, 1)
+	for id, sub := range s.subscribers {
+		msg, ok := encoded[sub.format]
+		if !ok {
+			var err error
+			msg, err = encodeEvent(sub.format, "SESSION_CLOSED", &sessionClosedData{Reason: reason})
+			if err == nil {
+				encoded[sub.format] = msg
+				ok = true
+			}
+		}
+
+		if ok && !s.deliverLocked(id, sub, msg) {
+			continue
+		}
+		delete(s.subscribers, id)
+		close(sub.events)
+	}
+	log.Printf("[session:%v] stopped (%v)", s.server.Name, reason)
+}
+
+// Fields of the server config which can be changed without restarting the session
+func copyReloadableConfig(dst *TacViewServerConfig, src *TacViewServerConfig) {
+	dst.RadarRefreshRate = src.RadarRefreshRate
+	dst.EnableFriendlyGroundUnits = src.EnableFriendlyGroundUnits
+	dst.EnableEnemyGroundUnits = src.EnableEnemyGroundUnits
+}
+
+// Returns whether a new config for this server can be applied to the running
+// session, or requires it to be restarted
+func (s *serverSession) canApplyConfig(server *TacViewServerConfig) bool {
+	s.state.RLock()
+	current := *s.server
+	s.state.RUnlock()
+
+	updated := *server
+	copyReloadableConfig(&updated, &current)
+	return reflect.DeepEqual(&current, &updated)
+}
+
+// Applies the reloadable fields of a new config for this server, subscribers
+// see ground units appear or disappear with the next radar snapshot
+func (s *serverSession) applyConfig(server *TacViewServerConfig) {
+	s.state.Lock()
+	defer s.state.Unlock()
+	copyReloadableConfig(s.server, server)
+}
+
+// Streams from Tacview until the connection closes or the session is stopped,
+// returning whether it was established. Stopping returns the contexts error.
+func (s *serverSession) runTacViewClient(endpoint TacViewEndpointConfig) (bool, error) {
+	var client tacViewSource
+	if s.server.Replay != nil {
+		client = NewTacViewReplay(s.server.Replay)
+	} else {
+		connectTimeout := s.server.ConnectTimeout
+		if connectTimeout <= 0 {
+			connectTimeout = defaultConnectTimeout
+		}
+		client = NewTacViewClient(
+			endpoint.Hostname,
+			endpoint.Port,
+			s.server.Password,
+			time.Duration(connectTimeout)*time.Second,
+			getReadTimeout(s.server),
+		)
+	}
+
 	header, timeFrameStream, err := client.Start()
 	if err != nil {
-		return err
+		return false, err
 	}
+	defer client.Close()
 
-	err = s.state.initialize(header)
+	// Replays restart from the beginning of the recording, so they never resume
+	resumed, err := s.state.initialize(header, s.server.Replay == nil)
 	if err != nil {
-		return err
+		return false, err
 	}
 
-	s.state.Lock()
-	objects := make([]*StateObject, len(s.state.objects))
-	var idx = 0
-	for _, object := range s.state.objects {
-		objects[idx] = object
-		idx += 1
+	// When the mission is unchanged subscribers keep their state and only
+	// receive the differences through the usual radar snapshots
+	var viewObjects map[string][]*StateObject
+	var viewGlobals map[string]*SessionGlobals
+	var mission *missionData
+	if !resumed {
+		s.state.Lock()
+		viewObjects = make(map[string][]*StateObject, len(s.views))
+		viewGlobals = make(map[string]*SessionGlobals, len(s.views))
+		for coalition, view := range s.views {
+			viewObjects[coalition] = view.reset(s.state.objects)
+			viewGlobals[coalition] = s.state.getGlobals(viewObjects[coalition])
+		}
+		offset := s.state.offset
+		rewindObjects := s.recordingView.reset(s.state.objects)
+		for idx, object := range rewindObjects {
+			rewindObjects[idx] = object.copy()
+		}
+		mission = newMissionData(&s.state)
+		s.state.Unlock()
+
+		s.Lock()
+		s.rewind.reset(rewindObjects, offset)
+		for _, sub := range s.subscribers {
+			sub.since = -1
+			if sub.scope != nil {
+				sub.scope.reset = true
+			}
+		}
+		s.Unlock()
 	}
-	s.state.Unlock()
 
-	log.Printf("[session:%v] tacview client session initialized", s.server.Name)
-	s.publish("SESSION_STATE", &sessionStateData{
-		SessionId: s.state.sessionId,
-		Objects:   objects,
-	})
+	// A mission ended while Tacview was disconnected for a long time is started
+	// again when it resumes
+	if resumed {
+		s.Lock()
+		ended := s.currentMissionLocked() == nil
+		s.Unlock()
+
+		if ended {
+			s.state.RLock()
+			mission = newMissionData(&s.state)
+			s.state.RUnlock()
+		}
+	}
+
+	var recorder *sessionRecorder
+	if s.server.RecordingPath != nil {
+		recorder, err = newSessionRecorder(s.server, s.state.sessionId, header)
+		if err != nil {
+			log.Printf("[session:%v] failed to start recording: %v", s.server.Name, err)
+		} else {
+			log.Printf("[session:%v] recording session to %v", s.server.Name, recorder.path)
+		}
+	}
+	defer func() {
+		if recorder != nil {
+			recorder.Close()
+		}
+	}()
+
+	if resumed {
+		log.Printf("[session:%v] tacview client session resumed", s.server.Name)
+	} else {
+		log.Printf("[session:%v] tacview client session initialized", s.server.Name)
+	}
+	s.setUpstream(upstreamConnected, nil)
+	if mission != nil {
+		s.startMission(mission)
+	}
+	for coalition, objects := range viewObjects {
+		s.publishTo(coalition, "SESSION_STATE", &sessionStateData{
+			SessionId: s.state.sessionId,
+			Objects:   objects,
+			Globals:   viewGlobals[coalition],
+		})
+	}
+
+	// Realtime servers stop sending frames while the mission is paused or when
+	// the connection hangs, the session is marked stale and then reconnected
+	var watchdog <-chan time.Time
+	if s.server.Replay == nil {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		watchdog = ticker.C
+	}
+	staleTimeout, stallTimeout := getStallTimeouts(s.server)
+	lastFrameAt := time.Now()
+	stale := false
+	frames := 0
 
 	for {
-		timeFrame, ok := <-timeFrameStream
+		var timeFrame *tacview.TimeFrame
+		var ok bool
+		select {
+		case timeFrame, ok = <-timeFrameStream:
+		case <-watchdog:
+			idle := time.Since(lastFrameAt)
+			if idle >= staleTimeout+stallTimeout {
+				log.Printf("[session:%v] no time frames received for %v, reconnecting", s.server.Name, idle.Round(time.Second))
+				return true, errTacViewStalled
+			} else if !stale && idle >= staleTimeout {
+				log.Printf("[session:%v] no time frames received for %v, marking stale", s.server.Name, idle.Round(time.Second))
+				stale = true
+				s.setUpstream(upstreamStale, nil)
+			}
+			continue
+		case <-s.ctx.Done():
+			return true, s.ctx.Err()
+		}
 		if !ok {
-			return nil
+			// An empty (e.g. truncated) recording is retried with the usual
+			// backoff rather than restarting it immediately
+			if err := client.Err(); err != nil || s.server.Replay == nil || frames > 0 {
+				return true, err
+			}
+			return false, errEmptyReplay
+		}
+
+		frames++
+		lastFrameAt = time.Now()
+		if stale {
+			log.Printf("[session:%v] time frames resumed", s.server.Name)
+			stale = false
+			s.setUpstream(upstreamConnected, nil)
 		}
 
 		s.state.Lock()
 		s.state.update(timeFrame)
+		if resumed {
+			s.state.reconcile()
+			resumed = false
+		}
 		s.state.Unlock()
+		atomic.AddInt64(&s.metrics.timeFrames, 1)
+
+		if recorder != nil {
+			err = recorder.writeTimeFrame(timeFrame)
+			if err != nil {
+				log.Printf("[session:%v] failed to write recording, stopping: %v", s.server.Name, err)
+				recorder.Close()
+				recorder = nil
+			}
+		}
 	}
 }
 
@@ -221,13 +816,78 @@ func (s *serverSession) removeSub(id int) {
 	delete(s.subscribers, id)
 }
 
-func (s *serverSession) addSub() (<-chan []byte, func()) {
-	sub := make(chan []byte, 16)
+func (s *serverSession) addSub(options subscriberOptions) (<-chan sessionEvent, func()) {
+	s.Lock()
+	defer s.Unlock()
+	return s.addSubLocked(options, -1, nil)
+}
+
+// Returns the number of subscribers with their own scope a server accepts
+func maxScopedSubscribers(server *TacViewServerConfig) int {
+	if server.MaxScopedSubscribers != 0 {
+		return server.MaxScopedSubscribers
+	}
+	return defaultMaxScopedSubscribers
+}
+
+// Adds a subscriber which receives radar snapshots from its own scope rather than
+// the sessions update loop, returning the state the scope starts from. Returns
+// errTooManyScopedSubscribers once the servers limit is reached.
+func (s *serverSession) addScopedSub(options subscriberOptions) (<-chan sessionEvent, func(), *sessionStateData, []*StateObject, error) {
+	view := s.views[options.coalition]
+
+	var state *sessionStateData
+	var objects []*StateObject
+
+	s.state.RLock()
+	limit := maxScopedSubscribers(s.server)
+	scope := newSubscriberScope(s.server, view, options)
+	if s.state.active {
+		objects = view.objects(s.state.objects)
+		scope.seed(objects)
+		if s.server.SendTrackHistory {
+			objects = view.attachHistory(objects)
+		}
+
+		state = &sessionStateData{
+			SessionId: s.state.sessionId,
+			Offset:    s.state.offset,
+			Globals:   s.state.getGlobals(objects),
+		}
+	}
+	s.state.RUnlock()
+
 	s.Lock()
+	defer s.Unlock()
+
+	scoped := 0
+	for _, sub := range s.subscribers {
+		if sub.scope != nil {
+			scoped++
+		}
+	}
+	if scoped >= limit {
+		return nil, nil, nil, nil, errTooManyScopedSubscribers
+	}
+
+	sub, closer := s.addSubLocked(options, -1, scope)
+	return sub, closer, state, objects, nil
+}
+
+// assumes you have the session lock
+func (s *serverSession) addSubLocked(options subscriberOptions, since int64, scope *subscriberScope) (<-chan sessionEvent, func()) {
+	sub := make(chan sessionEvent, 16)
+	if s.stopped {
+		close(sub)
+		return sub, func() {}
+	}
+
 	id := s.subscriberIdx
-	s.subscribers[id] = sub
+	s.subscribers[id] = &sessionSubscriber{subscriberOptions: options, events: sub, scope: scope, since: since}
 	s.subscriberIdx += 1
-	s.Unlock()
+	if scope != nil {
+		go s.scopeLoop(id, scope)
+	}
 	return sub, func() {
 		s.removeSub(id)
 	}
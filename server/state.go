@@ -18,22 +18,87 @@ type StateObject struct {
 	Longitude  float64           `json:"longitude"`
 	Altitude   float64           `json:"altitude"`
 	Heading    float64           `json:"heading"`
-	UpdatedAt  int64             `json:"updated_at"`
-	CreatedAt  int64             `json:"created_at"`
+
+	// Computed from successive positions, speeds are in meters per second and
+	// the track is the course over ground in degrees
+	GroundSpeed   float64 `json:"ground_speed"`
+	VerticalSpeed float64 `json:"vertical_speed"`
+	Track         float64 `json:"track"`
+
+	UpdatedAt int64 `json:"updated_at"`
+	CreatedAt int64 `json:"created_at"`
+
+	// Only populated on copies of the object sent to clients
+	History []StateHistoryPoint `json:"history,omitempty"`
 
 	Deleted bool `json:"-"`
+
+	history []StateHistoryPoint
+
+	// The position speed and track were last computed from
+	sample *positionSample
+
+	// Fields changed since the last radar snapshot, and the resulting delta
+	positionChanged   bool
+	velocityChanged   bool
+	typesChanged      bool
+	changedProperties map[string]bool
+	delta             *StateObjectDelta
+}
+
+// The changes to an object since the previous radar snapshot, unchanged fields
+// are omitted. Position, speeds and track are always sent together.
+type StateObjectDelta struct {
+	Id         uint64            `json:"id"`
+	Types      []string          `json:"types,omitempty"`
+	Properties map[string]string `json:"properties,omitempty"`
+
+	Latitude      *float64 `json:"latitude,omitempty"`
+	Longitude     *float64 `json:"longitude,omitempty"`
+	Altitude      *float64 `json:"altitude,omitempty"`
+	Heading       *float64 `json:"heading,omitempty"`
+	GroundSpeed   *float64 `json:"ground_speed,omitempty"`
+	VerticalSpeed *float64 `json:"vertical_speed,omitempty"`
+	Track         *float64 `json:"track,omitempty"`
+
+	UpdatedAt int64 `json:"updated_at"`
+}
+
+type positionSample struct {
+	offset    float64
+	latitude  float64
+	longitude float64
+	altitude  float64
 }
 
-func NewStateObject(ts int64, sourceObj *tacview.Object, coordBase [2]float64) (*StateObject, error) {
+// Minimum time (in seconds) between the samples used to compute speed and track
+const velocitySampleInterval = 1.0
+
+// Speed (in meters per second) under which an objects track is left unchanged
+const minimumTrackSpeed = 0.5
+
+// Time (in seconds) without a position update after which an object is treated
+// as stationary, Tacview only sends positions which have changed
+const velocityStaleInterval = 5.0
+
+type StateHistoryPoint struct {
+	Offset    int64   `json:"offset"`
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	Altitude  float64 `json:"altitude"`
+	Heading   float64 `json:"heading"`
+}
+
+func NewStateObject(offset float64, sourceObj *tacview.Object, coordBase [2]float64) (*StateObject, error) {
 	obj := &StateObject{
 		Id:         sourceObj.Id,
 		Types:      []string{},
 		Properties: make(map[string]string),
 		Deleted:    false,
-		CreatedAt:  ts,
+		CreatedAt:  int64(offset),
 	}
 
-	err := obj.update(ts, sourceObj, coordBase)
+	err := obj.update(offset, sourceObj, coordBase)
 	if err != nil {
 		return nil, err
 	}
@@ -41,6 +106,61 @@ func NewStateObject(ts int64, sourceObj *tacview.Object, coordBase [2]float64) (
 	return obj, nil
 }
 
+// Returns whether this object has the given Tacview type tag
+func (obj *StateObject) HasType(typeName string) bool {
+	for _, objectType := range obj.Types {
+		if objectType == typeName {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns a copy of this object which is safe to keep after further updates
+func (obj *StateObject) copy() *StateObject {
+	result := *obj
+	result.Properties = make(map[string]string, len(obj.Properties))
+	for key, value := range obj.Properties {
+		result.Properties[key] = value
+	}
+	result.History = nil
+	result.history = nil
+	result.changedProperties = nil
+	result.delta = nil
+	return &result
+}
+
+// Returns a copy of this object with its track history included
+func (obj *StateObject) withHistory() *StateObject {
+	result := obj.copy()
+	result.History = obj.getHistory()
+	return result
+}
+
+// Returns a copy of this objects track history
+func (obj *StateObject) getHistory() []StateHistoryPoint {
+	return append([]StateHistoryPoint{}, obj.history...)
+}
+
+// Records the current position of this object if it has moved since the last
+// recorded point, keeping at most length points
+func (obj *StateObject) recordHistory(length int) {
+	if len(obj.history) > 0 && obj.history[len(obj.history)-1].Offset >= obj.UpdatedAt {
+		return
+	}
+
+	obj.history = append(obj.history, StateHistoryPoint{
+		Offset:    obj.UpdatedAt,
+		Latitude:  obj.Latitude,
+		Longitude: obj.Longitude,
+		Altitude:  obj.Altitude,
+		Heading:   obj.Heading,
+	})
+	if len(obj.history) > length {
+		obj.history = obj.history[len(obj.history)-length:]
+	}
+}
+
 func (obj *StateObject) updateLocation(data string, coordBase [2]float64) error {
 	parts := strings.Split(data, "|")
 
@@ -80,7 +200,50 @@ func (obj *StateObject) updateLocation(data string, coordBase [2]float64) error
 	return nil
 }
 
-func (obj *StateObject) update(ts int64, sourceObj *tacview.Object, coordBase [2]float64) error {
+// Updates the computed speeds and track once enough time has passed since the last sample
+func (obj *StateObject) updateVelocity(offset float64) {
+	if obj.sample == nil {
+		obj.sample = &positionSample{offset, obj.Latitude, obj.Longitude, obj.Altitude}
+		return
+	}
+
+	elapsed := offset - obj.sample.offset
+	if elapsed < velocitySampleInterval {
+		return
+	}
+
+	distance := haversineDistance(obj.sample.latitude, obj.sample.longitude, obj.Latitude, obj.Longitude)
+	obj.GroundSpeed = distance / elapsed
+	obj.VerticalSpeed = (obj.Altitude - obj.sample.altitude) / elapsed
+	if obj.GroundSpeed >= minimumTrackSpeed {
+		obj.Track = initialBearing(obj.sample.latitude, obj.sample.longitude, obj.Latitude, obj.Longitude)
+	}
+
+	obj.sample = &positionSample{offset, obj.Latitude, obj.Longitude, obj.Altitude}
+}
+
+// Zeroes the speeds of an object which has not sent a position for a while,
+// returning whether they changed. As the object hasn't moved this isn't an
+// update, the speeds are only sent along with its next change.
+func (obj *StateObject) expireVelocity(offset float64) bool {
+	if obj.sample == nil || offset-obj.sample.offset < velocityStaleInterval {
+		return false
+	}
+
+	// Restart sampling from here so the first speed computed once the object
+	// moves again doesn't average over the time it was stationary
+	obj.sample = &positionSample{offset, obj.Latitude, obj.Longitude, obj.Altitude}
+	if obj.GroundSpeed == 0 && obj.VerticalSpeed == 0 {
+		return false
+	}
+
+	obj.GroundSpeed = 0
+	obj.VerticalSpeed = 0
+	obj.velocityChanged = true
+	return true
+}
+
+func (obj *StateObject) update(offset float64, sourceObj *tacview.Object, coordBase [2]float64) error {
 	if sourceObj.Deleted {
 		obj.Deleted = true
 	} else {
@@ -90,14 +253,21 @@ func (obj *StateObject) update(ts int64, sourceObj *tacview.Object, coordBase [2
 				if err != nil {
 					return err
 				}
+				obj.updateVelocity(offset)
+				obj.positionChanged = true
 			} else if prop.Key == "Type" {
 				obj.Types = strings.Split(prop.Value, "+")
+				obj.typesChanged = true
 			} else {
 				obj.Properties[prop.Key] = prop.Value
+				if obj.changedProperties == nil {
+					obj.changedProperties = make(map[string]bool)
+				}
+				obj.changedProperties[prop.Key] = true
 			}
 		}
 	}
-	obj.UpdatedAt = ts
+	obj.UpdatedAt = int64(offset)
 	return nil
 }
 
@@ -115,31 +285,52 @@ type sessionState struct {
 
 	offset int64
 	active bool
+
+	// Objects kept from before a reconnect which have not been sent again yet
+	unconfirmed map[uint64]bool
+
+	// Properties of the global object, which is also kept in objects for
+	// clients reading it directly
+	globals SessionGlobals
 }
 
-// Called when our connection is interrupted
+// Called when our connection is interrupted, assumes you have a lock
 func (s *sessionState) reset() {
-	s.Lock()
-	defer s.Unlock()
 	s.objects = make(map[uint64]*StateObject)
+	s.unconfirmed = nil
+	s.globals = SessionGlobals{}
 	s.active = false
 }
 
-// Called when the tacview stream starts
-func (s *sessionState) initialize(header *tacview.Header) error {
-	s.reset()
-
+// Called when the tacview stream starts, returning whether the stream continues
+// the mission already in the state. When resuming is allowed and the recording
+// time is unchanged the objects are kept and reconciled with the first time frame.
+func (s *sessionState) initialize(header *tacview.Header, allowResume bool) (bool, error) {
 	s.Lock()
 	defer s.Unlock()
 	globalObj := header.InitialTimeFrame.Get(0)
 	if globalObj == nil {
-		return errors.New("TacView initial time frame is missing global object")
+		s.reset()
+		return false, errors.New("TacView initial time frame is missing global object")
+	}
+
+	var sessionId string
+	if recordingTime := globalObj.Get("RecordingTime"); recordingTime != nil {
+		sessionId = recordingTime.Value
 	}
 
-	sessionId := globalObj.Get("RecordingTime")
-	if sessionId != nil {
-		s.sessionId = sessionId.Value
+	resumed := allowResume && s.active && sessionId != "" && sessionId == s.sessionId
+	if resumed {
+		s.unconfirmed = make(map[uint64]bool, len(s.objects))
+		for id, object := range s.objects {
+			if !object.Deleted {
+				s.unconfirmed[id] = true
+			}
+		}
+	} else {
+		s.reset()
 	}
+	s.sessionId = sessionId
 
 	refLat := globalObj.Get("ReferenceLatitude")
 	refLng := globalObj.Get("ReferenceLongitude")
@@ -147,30 +338,151 @@ func (s *sessionState) initialize(header *tacview.Header) error {
 	if refLat != nil && refLng != nil {
 		refLatF, err := strconv.ParseFloat(refLat.Value, 64)
 		if err != nil {
-			return err
+			return false, err
 		}
 		refLngF, err := strconv.ParseFloat(refLng.Value, 64)
 		if err != nil {
-			return err
+			return false, err
 		}
 
 		s.coordBase = [2]float64{refLatF, refLngF}
 	} else {
 		s.coordBase = [2]float64{0.0, 0.0}
 	}
+	s.globals.Theatre = detectTheatre(s.coordBase)
 
+	// The initial time frame may be older than the state being resumed
+	offset := s.offset
 	s.active = true
 	s.update(&header.InitialTimeFrame)
-	return nil
+	if resumed && s.offset < offset {
+		s.offset = offset
+	}
+	return resumed, nil
+}
+
+// Deletes the objects kept from before a reconnect which were not sent again,
+// called once the first time frame of a resumed stream (which contains every
+// object) has been applied. Assumes you have a lock.
+func (s *sessionState) reconcile() {
+	for id := range s.unconfirmed {
+		if object, ok := s.objects[id]; ok {
+			object.Deleted = true
+			object.UpdatedAt = s.offset
+		}
+	}
+	s.unconfirmed = nil
+}
+
+// Builds a delta containing the given parts of this object
+func (obj *StateObject) buildDelta(position bool, types bool, properties map[string]bool) *StateObjectDelta {
+	delta := &StateObjectDelta{Id: obj.Id, UpdatedAt: obj.UpdatedAt}
+
+	if position {
+		latitude, longitude, altitude, heading := obj.Latitude, obj.Longitude, obj.Altitude, obj.Heading
+		groundSpeed, verticalSpeed, track := obj.GroundSpeed, obj.VerticalSpeed, obj.Track
+		delta.Latitude, delta.Longitude, delta.Altitude, delta.Heading = &latitude, &longitude, &altitude, &heading
+		delta.GroundSpeed, delta.VerticalSpeed, delta.Track = &groundSpeed, &verticalSpeed, &track
+	}
+
+	if types {
+		delta.Types = obj.Types
+	}
+
+	if len(properties) > 0 {
+		delta.Properties = make(map[string]string, len(properties))
+		for key := range properties {
+			delta.Properties[key] = obj.Properties[key]
+		}
+	}
+
+	return delta
+}
+
+// Builds the delta of the fields changed since the last call and resets the
+// tracked changes. The delta is kept for use by radar snapshots.
+func (obj *StateObject) takeDelta() {
+	obj.delta = obj.buildDelta(obj.positionChanged || obj.velocityChanged, obj.typesChanged, obj.changedProperties)
+	obj.positionChanged = false
+	obj.velocityChanged = false
+	obj.typesChanged = false
+	obj.changedProperties = nil
+}
+
+// Returns the delta of this object since the last radar snapshot, or a delta
+// containing every field if no changes have been tracked (e.g. for copies)
+func (obj *StateObject) getDelta() *StateObjectDelta {
+	if obj.delta != nil {
+		return obj.delta
+	}
+
+	properties := make(map[string]bool, len(obj.Properties))
+	for key := range obj.Properties {
+		properties[key] = true
+	}
+	return obj.buildDelta(true, true, properties)
+}
+
+// Returns the delta between an earlier copy of this object and its current state
+func (obj *StateObject) diff(previous *StateObject) *StateObjectDelta {
+	position := obj.Latitude != previous.Latitude || obj.Longitude != previous.Longitude ||
+		obj.Altitude != previous.Altitude || obj.Heading != previous.Heading ||
+		obj.GroundSpeed != previous.GroundSpeed || obj.VerticalSpeed != previous.VerticalSpeed ||
+		obj.Track != previous.Track
+
+	types := len(obj.Types) != len(previous.Types)
+	for idx := 0; !types && idx < len(obj.Types); idx++ {
+		types = obj.Types[idx] != previous.Types[idx]
+	}
+
+	properties := make(map[string]bool)
+	for key, value := range obj.Properties {
+		if previousValue, ok := previous.Properties[key]; !ok || previousValue != value {
+			properties[key] = true
+		}
+	}
+
+	return obj.buildDelta(position, types, properties)
+}
+
+// Builds the deltas of every object updated after the given offset
+func (s *sessionState) takeDeltas(since int64) {
+	for _, object := range s.objects {
+		if !object.Deleted && object.UpdatedAt > since {
+			object.takeDelta()
+		}
+	}
+}
+
+// Zeroes the speeds of every object which has stopped sending positions
+func (s *sessionState) expireVelocities() {
+	for _, object := range s.objects {
+		if !object.Deleted {
+			object.expireVelocity(float64(s.offset))
+		}
+	}
+}
+
+// Records a track history point for every object which has moved since its last point
+func (s *sessionState) recordHistory(length int) {
+	for _, object := range s.objects {
+		if !object.Deleted {
+			object.recordHistory(length)
+		}
+	}
 }
 
 func (s *sessionState) update(tf *tacview.TimeFrame) {
 	s.offset = int64(tf.Offset)
 	for _, object := range tf.Objects {
+		delete(s.unconfirmed, object.Id)
+		if object.Id == 0 {
+			s.globals.update(object)
+		}
 		if _, exists := s.objects[object.Id]; exists {
-			s.objects[object.Id].update(int64(tf.Offset), object, s.coordBase)
+			s.objects[object.Id].update(tf.Offset, object, s.coordBase)
 		} else {
-			stateObj, err := NewStateObject(int64(tf.Offset), object, s.coordBase)
+			stateObj, err := NewStateObject(tf.Offset, object, s.coordBase)
 			if err != nil {
 				log.Printf("Error processing object: %v", err)
 				continue
@@ -0,0 +1,151 @@
+package server
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestExpireVelocityIsNotAnUpdate(t *testing.T) {
+	obj := &StateObject{
+		Id:          1,
+		Properties:  map[string]string{},
+		GroundSpeed: 100,
+		UpdatedAt:   10,
+		sample:      &positionSample{offset: 10},
+	}
+	obj.recordHistory(10)
+
+	if obj.expireVelocity(12) {
+		t.Fatalf("expected speeds to be kept within the stale interval")
+	}
+	if !obj.expireVelocity(10 + velocityStaleInterval) {
+		t.Fatalf("expected speeds to expire")
+	}
+	if obj.GroundSpeed != 0 || obj.UpdatedAt != 10 || obj.positionChanged {
+		t.Errorf("expected only the speeds to change, got %+v", obj)
+	}
+
+	obj.recordHistory(10)
+	if len(obj.history) != 1 {
+		t.Errorf("expected no history point to be added, got %v", obj.history)
+	}
+
+	// The zeroed speeds are sent with the next change
+	obj.Properties["Name"] = "F-16C"
+	obj.changedProperties = map[string]bool{"Name": true}
+	obj.takeDelta()
+	if obj.delta.GroundSpeed == nil || *obj.delta.GroundSpeed != 0 || obj.delta.Properties["Name"] != "F-16C" {
+		t.Errorf("expected the delta to include the zeroed speeds, got %+v", obj.delta)
+	}
+}
+
+func deltaTestObject() *StateObject {
+	return &StateObject{
+		Id:         1,
+		Types:      []string{"Air", "FixedWing"},
+		Properties: map[string]string{"Name": "F-16C_50", "Pilot": "Viper 1-1"},
+		Latitude:   34,
+		Longitude:  35,
+		Altitude:   3000,
+		UpdatedAt:  10,
+	}
+}
+
+func TestTakeDelta(t *testing.T) {
+	cases := []struct {
+		name       string
+		change     func(obj *StateObject)
+		position   bool
+		types      bool
+		properties map[string]string
+	}{
+		{"nothing", func(obj *StateObject) {}, false, false, nil},
+		{"position", func(obj *StateObject) {
+			obj.Latitude = 34.1
+			obj.positionChanged = true
+		}, true, false, nil},
+		{"property", func(obj *StateObject) {
+			obj.Properties["Pilot"] = "Viper 1-2"
+			obj.changedProperties = map[string]bool{"Pilot": true}
+		}, false, false, map[string]string{"Pilot": "Viper 1-2"}},
+		{"types", func(obj *StateObject) {
+			obj.Types = []string{"Air", "Rotorcraft"}
+			obj.typesChanged = true
+		}, false, true, nil},
+	}
+
+	for _, c := range cases {
+		obj := deltaTestObject()
+		c.change(obj)
+		obj.takeDelta()
+
+		delta := obj.getDelta()
+		if delta.Id != 1 || delta.UpdatedAt != 10 {
+			t.Errorf("%s: expected the id and updated_at to always be set, got %+v", c.name, delta)
+		}
+		if (delta.Latitude != nil) != c.position || (delta.GroundSpeed != nil) != c.position {
+			t.Errorf("%s: expected position fields to be set: %v, got %+v", c.name, c.position, delta)
+		}
+		if (delta.Types != nil) != c.types {
+			t.Errorf("%s: expected types to be set: %v, got %v", c.name, c.types, delta.Types)
+		}
+		if !reflect.DeepEqual(delta.Properties, c.properties) {
+			t.Errorf("%s: expected properties %v, got %v", c.name, c.properties, delta.Properties)
+		}
+		if obj.positionChanged || obj.typesChanged || obj.changedProperties != nil {
+			t.Errorf("%s: expected the tracked changes to be reset", c.name)
+		}
+	}
+}
+
+func TestToDeltasSendsFullObjectsWithoutTrackedChanges(t *testing.T) {
+	updated := deltaTestObject()
+	updated.Latitude = 34.1
+	updated.positionChanged = true
+	updated.takeDelta()
+
+	// Copies (e.g. from the rewind buffer) have no tracked changes
+	copied := deltaTestObject().copy()
+	copied.Id = 2
+
+	created := deltaTestObject()
+	created.Id = 3
+
+	deltas := (&sessionRadarSnapshotData{
+		Offset:  10,
+		Created: []*StateObject{created},
+		Updated: []*StateObject{updated, copied},
+		Deleted: []uint64{4},
+	}).toDeltas()
+
+	if len(deltas.Created) != 1 || deltas.Created[0] != created || !reflect.DeepEqual(deltas.Deleted, []uint64{4}) {
+		t.Errorf("expected created and deleted objects to be unchanged, got %+v", deltas)
+	}
+	if delta := deltas.Updated[0]; delta.Latitude == nil || *delta.Latitude != 34.1 || delta.Types != nil || delta.Properties != nil {
+		t.Errorf("expected only the position of the updated object, got %+v", delta)
+	}
+	if delta := deltas.Updated[1]; delta.Latitude == nil || delta.Types == nil || len(delta.Properties) != 2 {
+		t.Errorf("expected every field of the copied object, got %+v", delta)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	previous := deltaTestObject()
+
+	current := deltaTestObject()
+	current.Heading = 90
+	current.Properties["Pilot"] = "Viper 1-2"
+	current.Properties["Group"] = "Viper"
+	delta := current.diff(previous)
+	if delta.Heading == nil || *delta.Heading != 90 || delta.Types != nil {
+		t.Errorf("expected the position without types, got %+v", delta)
+	}
+	if !reflect.DeepEqual(delta.Properties, map[string]string{"Pilot": "Viper 1-2", "Group": "Viper"}) {
+		t.Errorf("expected the changed properties, got %v", delta.Properties)
+	}
+
+	delta = deltaTestObject().diff(previous)
+	if delta.Latitude != nil || delta.Types != nil || delta.Properties != nil {
+		t.Errorf("expected an empty delta for an unchanged object, got %+v", delta)
+	}
+}
@@ -0,0 +1,149 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/alioygur/gores"
+)
+
+// States of a sessions connection to its Tacview server
+const (
+	upstreamConnecting   = "connecting"
+	upstreamConnected    = "connected"
+	upstreamStale        = "stale"
+	upstreamDisconnected = "disconnected"
+)
+
+// Defaults (in seconds) for how long without time frames before a session is
+// marked stale, and how much longer before it is reconnected
+const (
+	defaultStaleTimeout = 10
+	defaultStallTimeout = 20
+)
+
+// Seconds by which reads from Tacview must outlast the stale and stall timeouts
+const readTimeoutMargin = 5
+
+var errTacViewStalled = errors.New("tacview stream stalled")
+
+// Classes of errors a Tacview connection closes with, a small fixed set so they
+// can be used as metric labels
+const (
+	tacViewErrorDial      = "dial"
+	tacViewErrorHandshake = "handshake"
+	tacViewErrorStall     = "stall"
+	tacViewErrorRead      = "read"
+	tacViewErrorEOF       = "eof"
+)
+
+// Returns the class of an error a Tacview connection closed with
+func classifyTacViewError(err error) string {
+	var opErr *net.OpError
+	var handshakeErr *tacViewHandshakeError
+	switch {
+	case errors.Is(err, errTacViewStalled):
+		return tacViewErrorStall
+	case errors.As(err, &handshakeErr):
+		return tacViewErrorHandshake
+	case errors.As(err, &opErr) && opErr.Op == "dial":
+		return tacViewErrorDial
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, errEmptyReplay):
+		return tacViewErrorEOF
+	default:
+		return tacViewErrorRead
+	}
+}
+
+type sessionStatusData struct {
+	State         string     `json:"state"`
+	ConnectedAt   *time.Time `json:"connected_at"`
+	LastError     *string    `json:"last_error"`
+	LastErrorAt   *time.Time `json:"last_error_at"`
+	Offset        int64      `json:"offset"`
+	RecordingTime string     `json:"recording_time"`
+}
+
+// Returns the status of the sessions connection to its Tacview server
+func (s *serverSession) getStatus() *sessionStatusData {
+	s.Lock()
+	result := &sessionStatusData{State: s.upstream}
+	if !s.connectedAt.IsZero() {
+		connectedAt := s.connectedAt
+		result.ConnectedAt = &connectedAt
+	}
+	if s.lastError != "" {
+		lastError, lastErrorAt := s.lastError, s.lastErrorAt
+		result.LastError = &lastError
+		result.LastErrorAt = &lastErrorAt
+	}
+	s.Unlock()
+
+	s.state.RLock()
+	if s.state.active {
+		result.Offset = s.state.offset
+		result.RecordingTime = s.state.sessionId
+	}
+	s.state.RUnlock()
+	return result
+}
+
+// Updates the state of the upstream connection, recording the error it closed
+// with if any, and notifies subscribers when the state changes
+func (s *serverSession) setUpstream(state string, err error) {
+	s.Lock()
+	changed := s.upstream != state
+	if state == upstreamConnected && s.upstream != upstreamStale {
+		s.connectedAt = time.Now()
+	}
+	s.upstream = state
+	if err != nil {
+		s.lastError = err.Error()
+		s.lastErrorClass = classifyTacViewError(err)
+		s.lastErrorAt = time.Now()
+	}
+	s.Unlock()
+
+	if changed {
+		s.publish("SESSION_STATUS", s.getStatus())
+	}
+}
+
+// Returns how long without time frames before a server is marked stale, and how
+// much longer before it is reconnected
+func getStallTimeouts(server *TacViewServerConfig) (time.Duration, time.Duration) {
+	staleTimeout := server.StaleTimeout
+	if staleTimeout <= 0 {
+		staleTimeout = defaultStaleTimeout
+	}
+	stallTimeout := server.StallTimeout
+	if stallTimeout <= 0 {
+		stallTimeout = defaultStallTimeout
+	}
+	return time.Duration(staleTimeout) * time.Second, time.Duration(stallTimeout) * time.Second
+}
+
+// Returns the time allowed for each read from Tacview. Reads must outlast the
+// stall watchdog (which checks once a second), otherwise a paused mission would
+// be disconnected before ever being marked stale.
+func getReadTimeout(server *TacViewServerConfig) time.Duration {
+	if server.ReadTimeout > 0 {
+		return time.Duration(server.ReadTimeout) * time.Second
+	}
+
+	staleTimeout, stallTimeout := getStallTimeouts(server)
+	return staleTimeout + stallTimeout + readTimeoutMargin*time.Second
+}
+
+// Returns the status of a servers connection to Tacview
+func (h *httpServer) getServerStatus(w http.ResponseWriter, r *http.Request) {
+	session := h.ensureSession(w, r)
+	if session == nil {
+		return
+	}
+
+	gores.JSON(w, 200, session.getStatus())
+}
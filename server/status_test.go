@@ -0,0 +1,32 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"testing"
+)
+
+func TestClassifyTacViewError(t *testing.T) {
+	cases := []struct {
+		err      error
+		expected string
+	}{
+		{&net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}, tacViewErrorDial},
+		{&tacViewHandshakeError{errInvalidTacViewHandshake}, tacViewErrorHandshake},
+		{&tacViewHandshakeError{io.EOF}, tacViewErrorHandshake},
+		{errTacViewStalled, tacViewErrorStall},
+		{&net.OpError{Op: "read", Net: "tcp", Err: os.ErrDeadlineExceeded}, tacViewErrorRead},
+		{io.EOF, tacViewErrorEOF},
+		{fmt.Errorf("reading frame: %w", io.ErrUnexpectedEOF), tacViewErrorEOF},
+		{errEmptyReplay, tacViewErrorEOF},
+	}
+
+	for _, c := range cases {
+		if class := classifyTacViewError(c.err); class != c.expected {
+			t.Errorf("classifyTacViewError(%v) = %v, expected %v", c.err, class, c.expected)
+		}
+	}
+}
@@ -1,32 +1,238 @@
 package server
 
 import (
+	"bufio"
+	"errors"
 	"fmt"
+	"hash/crc64"
+	"math"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf16"
 
 	"github.com/b1naryth1ef/jambon/tacview"
 )
 
+// A source of Tacview data, either a realtime server or a replayed recording
+type tacViewSource interface {
+	Start() (*tacview.Header, chan *tacview.TimeFrame, error)
+
+	// Returns the error the stream ended with, valid once its channel is closed
+	Err() error
+
+	// Stops the stream, releasing its connection or file. Frames which were not
+	// received yet are dropped.
+	Close()
+}
+
+const (
+	defaultTacViewPort = 42674
+
+	// Default (in seconds) for connecting to Tacview servers
+	defaultConnectTimeout = 10
+)
+
+var errInvalidTacViewHandshake = errors.New("invalid tacview handshake")
+
+// An error connecting to Tacview after dialing but before any data was received
+type tacViewHandshakeError struct {
+	err error
+}
+
+func (e *tacViewHandshakeError) Error() string {
+	return "tacview handshake failed: " + e.err.Error()
+}
+
+func (e *tacViewHandshakeError) Unwrap() error {
+	return e.err
+}
+
 type TacViewClient struct {
 	host     string
 	port     int
 	password string
+
+	connectTimeout time.Duration
+	readTimeout    time.Duration
+
+	conn      net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	err error
 }
 
-func NewTacViewClient(host string, port int, password string) *TacViewClient {
+func NewTacViewClient(host string, port int, password string, connectTimeout time.Duration, readTimeout time.Duration) *TacViewClient {
 	if port == 0 {
-		port = 42674
+		port = defaultTacViewPort
+	}
+
+	return &TacViewClient{
+		host:           host,
+		port:           port,
+		password:       password,
+		connectTimeout: connectTimeout,
+		readTimeout:    readTimeout,
+		closed:         make(chan struct{}),
+	}
+}
+
+// A connection which fails reads that take longer than the timeout, so a
+// half-open connection doesn't stall the stream forever
+type deadlineConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *deadlineConn) Read(b []byte) (int, error) {
+	err := c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+	if err != nil {
+		return 0, err
 	}
+	return c.Conn.Read(b)
+}
 
-	return &TacViewClient{host: host, port: port, password: password}
+// Hashes a password the way Tacview expects, the CRC64 (ECMA) of its UTF-16
+// little endian encoding formatted as hex
+func hashTacViewPassword(password string) string {
+	encoded := utf16.Encode([]rune(password))
+	data := make([]byte, 0, len(encoded)*2)
+	for _, char := range encoded {
+		data = append(data, byte(char), byte(char>>8))
+	}
+	return strconv.FormatUint(crc64.Checksum(data, crc64.MakeTable(crc64.ECMA)), 16)
+}
+
+// Performs the realtime telemetry handshake the same way jambons realtime
+// reader does, but on a connection we dialed so it keeps our timeouts. The
+// server sends its protocol, version and hostname, and expects the same from
+// us along with the password hash.
+func tacViewHandshake(conn net.Conn, reader *bufio.Reader, username string, password string, timeout time.Duration) error {
+	for _, expected := range []string{"XtraLib.Stream.0\n", "Tacview.RealTimeTelemetry.0\n"} {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		if line != expected {
+			return errInvalidTacViewHandshake
+		}
+	}
+
+	_, err := reader.ReadString('\x00')
+	if err != nil {
+		return err
+	}
+
+	err = conn.SetWriteDeadline(time.Now().Add(timeout))
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(
+		conn,
+		"XtraLib.Stream.0\nTacview.RealTimeTelemetry.0\n%s\n%s\x00",
+		username,
+		hashTacViewPassword(password),
+	)
+	return err
 }
 
 func (c *TacViewClient) Start() (*tacview.Header, chan *tacview.TimeFrame, error) {
-	reader, err := tacview.NewRealTimeReader(fmt.Sprintf("%s:%d", c.host, c.port), "sneakerserver", c.password)
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(c.host, strconv.Itoa(c.port)), c.connectTimeout)
 	if err != nil {
 		return nil, nil, err
 	}
+	c.conn = conn
+
+	reader := bufio.NewReader(&deadlineConn{Conn: conn, timeout: c.readTimeout})
+	err = tacViewHandshake(conn, reader, "sneakerserver", c.password, c.readTimeout)
+	if err != nil {
+		conn.Close()
+		return nil, nil, &tacViewHandshakeError{err}
+	}
+
+	tacviewReader, err := tacview.NewReader(reader)
+	if err != nil {
+		conn.Close()
+		return nil, nil, &tacViewHandshakeError{err}
+	}
+
+	frames := make(chan *tacview.TimeFrame, 1)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- tacviewReader.ProcessTimeFrames(1, frames)
+	}()
 
 	data := make(chan *tacview.TimeFrame, 1)
-	go reader.ProcessTimeFrames(1, data)
-	return &reader.Header, data, nil
+	go func() {
+		defer close(data)
+		defer conn.Close()
+
+		for timeFrame := range frames {
+			select {
+			case data <- timeFrame:
+			case <-c.closed:
+			}
+		}
+		c.err = <-errs
+	}()
+
+	return &tacviewReader.Header, data, nil
+}
+
+func (c *TacViewClient) Err() error {
+	return c.err
+}
+
+// Closes the connection, which ends the reader
+func (c *TacViewClient) Close() {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		if c.conn != nil {
+			c.conn.Close()
+		}
+	})
+}
+
+// Returns the Tacview servers to connect to, the primary followed by its alternates
+func tacViewEndpoints(server *TacViewServerConfig) []TacViewEndpointConfig {
+	endpoints := []TacViewEndpointConfig{{Hostname: server.Hostname, Port: server.Port}}
+	return append(endpoints, server.AlternateEndpoints...)
+}
+
+// Default delays (in seconds) between attempts to reconnect
+const (
+	defaultReconnectMinDelay   = 1
+	defaultReconnectMaxDelay   = 60
+	defaultReconnectMultiplier = 2
+	defaultReconnectJitter     = 0.2
+)
+
+// Returns how long to wait before a reconnect attempt, growing exponentially
+// with the number of consecutive failed attempts
+func reconnectDelay(config *ReconnectConfig, attempt int) time.Duration {
+	minDelay := float64(defaultReconnectMinDelay)
+	maxDelay := float64(defaultReconnectMaxDelay)
+	multiplier := float64(defaultReconnectMultiplier)
+	jitter := defaultReconnectJitter
+	if config != nil {
+		if config.MinDelay > 0 {
+			minDelay = config.MinDelay
+		}
+		if config.MaxDelay > 0 {
+			maxDelay = config.MaxDelay
+		}
+		if config.Multiplier >= 1 {
+			multiplier = config.Multiplier
+		}
+		if config.Jitter != nil {
+			jitter = math.Max(0, math.Min(1, *config.Jitter))
+		}
+	}
+
+	delay := math.Min(minDelay*math.Pow(multiplier, float64(attempt)), maxDelay)
+	delay *= 1 + jitter*(rand.Float64()*2-1)
+	return time.Duration(delay * float64(time.Second))
 }
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+)
+
+// Runs the handshake against a fake Tacview server which sends the given
+// header, returning what the client sent back and the handshake error
+func runTacViewHandshake(t *testing.T, header string, password string) (string, error) {
+	t.Helper()
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	sent := make(chan string, 1)
+	go func() {
+		defer close(sent)
+		if _, err := server.Write([]byte(header)); err != nil {
+			return
+		}
+		line, err := bufio.NewReader(server).ReadString('\x00')
+		if err == nil {
+			sent <- line
+		}
+	}()
+
+	reader := bufio.NewReader(&deadlineConn{Conn: client, timeout: time.Millisecond * 100})
+	err := tacViewHandshake(client, reader, "sneakerserver", password, time.Millisecond*100)
+	client.Close()
+	return <-sent, err
+}
+
+func TestTacViewHandshake(t *testing.T) {
+	sent, err := runTacViewHandshake(t, "XtraLib.Stream.0\nTacview.RealTimeTelemetry.0\nhost\n\x00", "secret")
+	if err != nil {
+		t.Fatalf("handshake failed: %v", err)
+	}
+
+	expected := "XtraLib.Stream.0\nTacview.RealTimeTelemetry.0\nsneakerserver\n" + hashTacViewPassword("secret") + "\x00"
+	if sent != expected {
+		t.Errorf("expected the client to send %q, got %q", expected, sent)
+	}
+}
+
+func TestTacViewHandshakeRejectsOtherProtocols(t *testing.T) {
+	headers := []string{
+		"HTTP/1.1 200 OK\n",
+		"XtraLib.Stream.0\nTacview.Other.0\nhost\n\x00",
+	}
+
+	for _, header := range headers {
+		_, err := runTacViewHandshake(t, header, "")
+		if err != errInvalidTacViewHandshake {
+			t.Errorf("expected errInvalidTacViewHandshake for %q, got %v", header, err)
+		}
+	}
+}
+
+func TestTacViewHandshakeTimesOut(t *testing.T) {
+	// The server never finishes its header
+	_, err := runTacViewHandshake(t, "XtraLib.Stream.0\n", "")
+	if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		t.Errorf("expected a timeout, got %v", err)
+	}
+}
+
+func TestHashTacViewPassword(t *testing.T) {
+	if hash := hashTacViewPassword(""); hash != "0" {
+		t.Errorf("expected an empty password to hash to 0, got %v", hash)
+	}
+	if hashTacViewPassword("secret") == hashTacViewPassword("Secret") {
+		t.Errorf("expected different passwords to hash differently")
+	}
+}
+
+func TestReconnectDelay(t *testing.T) {
+	jitter := func(value float64) *float64 {
+		return &value
+	}
+
+	cases := []struct {
+		name    string
+		config  *ReconnectConfig
+		attempt int
+		min     time.Duration
+		max     time.Duration
+	}{
+		{"defaults first attempt", nil, 0, time.Millisecond * 800, time.Millisecond * 1200},
+		{"defaults grow", nil, 3, time.Millisecond * 6400, time.Millisecond * 9600},
+		{"defaults capped", nil, 20, time.Second * 48, time.Second * 72},
+		{"no jitter", &ReconnectConfig{MinDelay: 2, MaxDelay: 30, Multiplier: 3, Jitter: jitter(0)}, 2, time.Second * 18, time.Second * 18},
+		{"no jitter capped", &ReconnectConfig{MinDelay: 2, MaxDelay: 30, Multiplier: 3, Jitter: jitter(0)}, 5, time.Second * 30, time.Second * 30},
+		{"multiplier below one ignored", &ReconnectConfig{Multiplier: 0.5, Jitter: jitter(0)}, 2, time.Second * 4, time.Second * 4},
+		{"negative jitter clamped", &ReconnectConfig{Jitter: jitter(-1)}, 0, time.Second, time.Second},
+		{"jitter above one clamped", &ReconnectConfig{MinDelay: 10, Jitter: jitter(5)}, 0, 0, time.Second * 20},
+	}
+
+	for _, c := range cases {
+		for idx := 0; idx < 100; idx++ {
+			delay := reconnectDelay(c.config, c.attempt)
+			if delay < c.min || delay > c.max {
+				t.Errorf("%s: expected a delay between %v and %v, got %v", c.name, c.min, c.max, delay)
+				break
+			}
+		}
+	}
+}
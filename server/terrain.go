@@ -0,0 +1,538 @@
+package server
+
+import (
+	"container/list"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+// Maximum number of elevation tiles kept in memory per terrain data directory
+const terrainTileCacheSize = 64
+
+// Spacing (in meters) between terrain samples when checking line of sight
+const terrainSampleSpacing = 250.0
+
+// Maximum number of terrain samples taken when checking line of sight
+const terrainMaxSamples = 400
+
+var errUnsupportedTerrainFile = errors.New("unsupported terrain file")
+
+// A grid of elevations (in meters) covering an area, rows run north to south
+// and columns west to east.
+type elevationTile struct {
+	north   float64
+	west    float64
+	latStep float64
+	lngStep float64
+	rows    int
+	cols    int
+	data    []float32
+}
+
+// Returns the bilinearly interpolated elevation at a point, and whether the point
+// falls within the tile
+func (t *elevationTile) elevation(lat, lng float64) (float64, bool) {
+	row := (t.north - lat) / t.latStep
+	col := (lng - t.west) / t.lngStep
+	if row < 0 || col < 0 || row > float64(t.rows-1) || col > float64(t.cols-1) {
+		return 0, false
+	}
+
+	row0, col0 := int(row), int(col)
+	row1, col1 := row0+1, col0+1
+	if row1 >= t.rows {
+		row1 = row0
+	}
+	if col1 >= t.cols {
+		col1 = col0
+	}
+
+	fr, fc := row-float64(row0), col-float64(col0)
+	top := float64(t.data[row0*t.cols+col0])*(1-fc) + float64(t.data[row0*t.cols+col1])*fc
+	bottom := float64(t.data[row1*t.cols+col0])*(1-fc) + float64(t.data[row1*t.cols+col1])*fc
+	return top*(1-fr) + bottom*fr, true
+}
+
+// Elevation data loaded lazily from a directory of DTED or GeoTIFF tiles. DTED
+// tiles use the standard `e032/n34.dt1` layout while GeoTIFF tiles are named
+// after their south-west corner (e.g. `N34E032.tif`). Tiles are read in the
+// background the first time they are needed, so lookups (which happen while the
+// session state is locked) never wait on the disk.
+type terrainData struct {
+	sync.Mutex
+
+	path string
+
+	// Cached tiles, ordered from most to least recently used
+	tiles map[[2]int]*list.Element
+	order *list.List
+
+	// Tiles currently being read
+	loading map[[2]int]bool
+}
+
+type cachedElevationTile struct {
+	key  [2]int
+	tile *elevationTile
+}
+
+func newTerrainData(path string) *terrainData {
+	return &terrainData{
+		path:    path,
+		tiles:   make(map[[2]int]*list.Element),
+		order:   list.New(),
+		loading: make(map[[2]int]bool),
+	}
+}
+
+// Returns the whole degree cell containing a point
+func terrainTileKey(lat, lng float64) [2]int {
+	return [2]int{int(math.Floor(lat)), int(math.Floor(lng))}
+}
+
+// Returns the tile for a cell, or nil if there is no data for it or it has not
+// been read yet. Assumes you have the terrain lock.
+func (t *terrainData) tileLocked(key [2]int) *elevationTile {
+	if element, ok := t.tiles[key]; ok {
+		t.order.MoveToFront(element)
+		return element.Value.(*cachedElevationTile).tile
+	}
+
+	if !t.loading[key] {
+		t.loading[key] = true
+		go t.loadTile(key)
+	}
+	return nil
+}
+
+// Reads a tile into the cache, evicting the least recently used tile if full
+func (t *terrainData) loadTile(key [2]int) {
+	tile, err := loadElevationTile(t.path, key[0], key[1])
+	if err != nil {
+		log.Printf("[terrain] failed to load tile %v: %v", key, err)
+	}
+
+	t.Lock()
+	defer t.Unlock()
+	delete(t.loading, key)
+
+	// Missing tiles are cached too so we don't hit the disk for every lookup
+	t.tiles[key] = t.order.PushFront(&cachedElevationTile{key: key, tile: tile})
+	if t.order.Len() > terrainTileCacheSize {
+		oldest := t.order.Back()
+		t.order.Remove(oldest)
+		delete(t.tiles, oldest.Value.(*cachedElevationTile).key)
+	}
+}
+
+// Starts reading the tile covering a point so it is available once needed
+func (t *terrainData) preload(lat, lng float64) {
+	t.Lock()
+	defer t.Unlock()
+	t.tileLocked(terrainTileKey(lat, lng))
+}
+
+// Returns the terrain elevation at a point, or zero where no data is available
+// (yet)
+func (t *terrainData) elevation(lat, lng float64) float64 {
+	t.Lock()
+	tile := t.tileLocked(terrainTileKey(lat, lng))
+	t.Unlock()
+
+	return tileElevation(tile, lat, lng)
+}
+
+func tileElevation(tile *elevationTile, lat, lng float64) float64 {
+	if tile == nil {
+		return 0
+	}
+
+	elevation, ok := tile.elevation(lat, lng)
+	if !ok {
+		return 0
+	}
+	return elevation
+}
+
+// Returns whether the straight line between two points (altitudes MSL, in meters)
+// clears the terrain, accounting for earth curvature and standard refraction
+func (t *terrainData) lineOfSight(latA, lngA, altA, latB, lngB, altB float64) bool {
+	distance := haversineDistance(latA, lngA, latB, lngB)
+	samples := int(distance / terrainSampleSpacing)
+	if samples > terrainMaxSamples {
+		samples = terrainMaxSamples
+	}
+
+	t.Lock()
+	defer t.Unlock()
+
+	// Consecutive samples almost always fall within the same tile
+	var key [2]int
+	var tile *elevationTile
+	effectiveRadius := radarRefractionFactor * earthRadiusMeters
+	for i := 1; i < samples; i++ {
+		fraction := float64(i) / float64(samples)
+		fromA := distance * fraction
+		fromB := distance - fromA
+
+		rayAltitude := altA + (altB-altA)*fraction - (fromA*fromB)/(2*effectiveRadius)
+		lat := latA + (latB-latA)*fraction
+		lng := lngA + (lngB-lngA)*fraction
+		if sampleKey := terrainTileKey(lat, lng); i == 1 || sampleKey != key {
+			key = sampleKey
+			tile = t.tileLocked(key)
+		}
+		if tileElevation(tile, lat, lng) >= rayAltitude {
+			return false
+		}
+	}
+	return true
+}
+
+func formatTileCoordinate(value int, positive string, negative string, width int) string {
+	prefix := positive
+	if value < 0 {
+		prefix = negative
+		value = -value
+	}
+	return fmt.Sprintf("%s%0*d", prefix, width, value)
+}
+
+// Loads the tile covering the given whole degree cell, returns nil if none exists
+func loadElevationTile(path string, lat int, lng int) (*elevationTile, error) {
+	dtedDir := filepath.Join(path, formatTileCoordinate(lng, "e", "w", 3))
+	for _, level := range []string{"dt2", "dt1", "dt0"} {
+		tilePath := filepath.Join(dtedDir, formatTileCoordinate(lat, "n", "s", 2)+"."+level)
+		if _, err := os.Stat(tilePath); err == nil {
+			return loadDTEDTile(tilePath)
+		}
+	}
+
+	name := formatTileCoordinate(lat, "N", "S", 2) + formatTileCoordinate(lng, "E", "W", 3)
+	for _, extension := range []string{".tif", ".tiff"} {
+		tilePath := filepath.Join(path, name+extension)
+		if _, err := os.Stat(tilePath); err == nil {
+			return loadGeoTIFFTile(tilePath)
+		}
+	}
+
+	return nil, nil
+}
+
+const (
+	dtedHeaderLength     = 3428
+	dtedRecordOverhead   = 12
+	dtedNullElevation    = -32767
+	dtedElevationSignBit = 0x8000
+)
+
+// Parses a DTED coordinate in the DDDMMSSH format
+func parseDTEDCoordinate(data []byte) (float64, error) {
+	degrees, err := strconv.Atoi(string(data[0:3]))
+	if err != nil {
+		return 0, err
+	}
+	minutes, err := strconv.Atoi(string(data[3:5]))
+	if err != nil {
+		return 0, err
+	}
+	seconds, err := strconv.Atoi(string(data[5:7]))
+	if err != nil {
+		return 0, err
+	}
+
+	value := float64(degrees) + float64(minutes)/60 + float64(seconds)/3600
+	if data[7] == 'S' || data[7] == 'W' {
+		value = -value
+	}
+	return value, nil
+}
+
+func loadDTEDTile(path string) (*elevationTile, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < dtedHeaderLength || string(data[0:3]) != "UHL" {
+		return nil, errUnsupportedTerrainFile
+	}
+
+	west, err := parseDTEDCoordinate(data[4:12])
+	if err != nil {
+		return nil, err
+	}
+	south, err := parseDTEDCoordinate(data[12:20])
+	if err != nil {
+		return nil, err
+	}
+	lngInterval, err := strconv.Atoi(string(data[20:24]))
+	if err != nil {
+		return nil, err
+	}
+	latInterval, err := strconv.Atoi(string(data[24:28]))
+	if err != nil {
+		return nil, err
+	}
+	cols, err := strconv.Atoi(string(data[47:51]))
+	if err != nil {
+		return nil, err
+	}
+	rows, err := strconv.Atoi(string(data[51:55]))
+	if err != nil {
+		return nil, err
+	}
+
+	if rows <= 0 || cols <= 0 || latInterval <= 0 || lngInterval <= 0 {
+		return nil, errUnsupportedTerrainFile
+	}
+
+	recordLength := dtedRecordOverhead + rows*2
+	if len(data) < dtedHeaderLength+cols*recordLength {
+		return nil, errUnsupportedTerrainFile
+	}
+
+	// Intervals are stored in tenths of an arc second
+	latStep := float64(latInterval) / 36000
+	lngStep := float64(lngInterval) / 36000
+
+	tile := &elevationTile{
+		north:   south + latStep*float64(rows-1),
+		west:    west,
+		latStep: latStep,
+		lngStep: lngStep,
+		rows:    rows,
+		cols:    cols,
+		data:    make([]float32, rows*cols),
+	}
+
+	// Each record is a single column of elevations running south to north
+	for col := 0; col < cols; col++ {
+		record := data[dtedHeaderLength+col*recordLength+8:]
+		for point := 0; point < rows; point++ {
+			raw := binary.BigEndian.Uint16(record[point*2:])
+
+			// Elevations are stored as signed magnitude rather than two's complement
+			elevation := int(raw &^ dtedElevationSignBit)
+			if raw&dtedElevationSignBit != 0 {
+				elevation = -elevation
+			}
+			if elevation == dtedNullElevation {
+				elevation = 0
+			}
+
+			tile.data[(rows-1-point)*cols+col] = float32(elevation)
+		}
+	}
+
+	return tile, nil
+}
+
+const (
+	tiffTagImageWidth       = 256
+	tiffTagImageLength      = 257
+	tiffTagBitsPerSample    = 258
+	tiffTagCompression      = 259
+	tiffTagStripOffsets     = 273
+	tiffTagSamplesPerPixel  = 277
+	tiffTagRowsPerStrip     = 278
+	tiffTagSampleFormat     = 339
+	tiffTagModelPixelScale  = 33550
+	tiffTagModelTiepoint    = 33922
+	tiffSampleFormatInt     = 2
+	tiffSampleFormatFloat   = 3
+	tiffTypeShort           = 3
+	tiffTypeLong            = 4
+	tiffTypeDouble          = 12
+	tiffCompressionNone     = 1
+	tiffDefaultSampleFormat = 1
+)
+
+type tiffField struct {
+	fieldType uint16
+	count     uint32
+	offset    []byte
+}
+
+// Loads a single band, uncompressed, strip-based GeoTIFF in geographic coordinates
+func loadGeoTIFFTile(path string) (*elevationTile, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < 8 {
+		return nil, errUnsupportedTerrainFile
+	}
+
+	var order binary.ByteOrder
+	switch string(data[0:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return nil, errUnsupportedTerrainFile
+	}
+
+	ifdOffset := int(order.Uint32(data[4:]))
+	if ifdOffset+2 > len(data) {
+		return nil, errUnsupportedTerrainFile
+	}
+
+	fields := make(map[uint16]tiffField)
+	entries := int(order.Uint16(data[ifdOffset:]))
+	for i := 0; i < entries; i++ {
+		entry := ifdOffset + 2 + i*12
+		if entry+12 > len(data) {
+			return nil, errUnsupportedTerrainFile
+		}
+		fields[order.Uint16(data[entry:])] = tiffField{
+			fieldType: order.Uint16(data[entry+2:]),
+			count:     order.Uint32(data[entry+4:]),
+			offset:    data[entry+8 : entry+12],
+		}
+	}
+
+	// Returns the values of an integer field, following the offset if they don't fit inline
+	integers := func(tag uint16) []int {
+		field, ok := fields[tag]
+		if !ok {
+			return nil
+		}
+
+		size := 2
+		if field.fieldType == tiffTypeLong {
+			size = 4
+		} else if field.fieldType != tiffTypeShort {
+			return nil
+		}
+
+		raw := field.offset
+		if int(field.count)*size > 4 {
+			start := int(order.Uint32(field.offset))
+			if start+int(field.count)*size > len(data) {
+				return nil
+			}
+			raw = data[start:]
+		}
+
+		result := make([]int, field.count)
+		for i := range result {
+			if size == 2 {
+				result[i] = int(order.Uint16(raw[i*2:]))
+			} else {
+				result[i] = int(order.Uint32(raw[i*4:]))
+			}
+		}
+		return result
+	}
+
+	doubles := func(tag uint16) []float64 {
+		field, ok := fields[tag]
+		if !ok || field.fieldType != tiffTypeDouble {
+			return nil
+		}
+
+		start := int(order.Uint32(field.offset))
+		if start+int(field.count)*8 > len(data) {
+			return nil
+		}
+
+		result := make([]float64, field.count)
+		for i := range result {
+			result[i] = math.Float64frombits(order.Uint64(data[start+i*8:]))
+		}
+		return result
+	}
+
+	width, height := integers(tiffTagImageWidth), integers(tiffTagImageLength)
+	bitsPerSample := integers(tiffTagBitsPerSample)
+	stripOffsets := integers(tiffTagStripOffsets)
+	pixelScale := doubles(tiffTagModelPixelScale)
+	tiepoint := doubles(tiffTagModelTiepoint)
+	if len(width) != 1 || len(height) != 1 || len(bitsPerSample) != 1 || len(stripOffsets) == 0 ||
+		len(pixelScale) < 2 || len(tiepoint) < 6 {
+		return nil, errUnsupportedTerrainFile
+	}
+
+	if compression := integers(tiffTagCompression); len(compression) == 1 && compression[0] != tiffCompressionNone {
+		return nil, fmt.Errorf("compressed GeoTIFFs are not supported (%s)", path)
+	}
+	if samples := integers(tiffTagSamplesPerPixel); len(samples) == 1 && samples[0] != 1 {
+		return nil, errUnsupportedTerrainFile
+	}
+
+	sampleFormat := tiffDefaultSampleFormat
+	if format := integers(tiffTagSampleFormat); len(format) == 1 {
+		sampleFormat = format[0]
+	}
+
+	rowsPerStrip := height[0]
+	if value := integers(tiffTagRowsPerStrip); len(value) == 1 && value[0] < height[0] {
+		rowsPerStrip = value[0]
+	}
+	if width[0] <= 0 || height[0] <= 0 || rowsPerStrip <= 0 || pixelScale[0] <= 0 || pixelScale[1] <= 0 {
+		return nil, errUnsupportedTerrainFile
+	}
+
+	bytesPerSample := bitsPerSample[0] / 8
+	if bytesPerSample != 2 && bytesPerSample != 4 {
+		return nil, errUnsupportedTerrainFile
+	}
+
+	tile := &elevationTile{
+		north:   tiepoint[4] + tiepoint[1]*pixelScale[1],
+		west:    tiepoint[3] - tiepoint[0]*pixelScale[0],
+		latStep: pixelScale[1],
+		lngStep: pixelScale[0],
+		rows:    height[0],
+		cols:    width[0],
+		data:    make([]float32, height[0]*width[0]),
+	}
+
+	for row := 0; row < tile.rows; row++ {
+		strip := row / rowsPerStrip
+		if strip >= len(stripOffsets) {
+			return nil, errUnsupportedTerrainFile
+		}
+
+		start := stripOffsets[strip] + (row%rowsPerStrip)*tile.cols*bytesPerSample
+		if start+tile.cols*bytesPerSample > len(data) {
+			return nil, errUnsupportedTerrainFile
+		}
+
+		for col := 0; col < tile.cols; col++ {
+			raw := data[start+col*bytesPerSample:]
+
+			var elevation float32
+			switch {
+			case bytesPerSample == 4 && sampleFormat == tiffSampleFormatFloat:
+				elevation = math.Float32frombits(order.Uint32(raw))
+			case bytesPerSample == 4 && sampleFormat == tiffSampleFormatInt:
+				elevation = float32(int32(order.Uint32(raw)))
+			case bytesPerSample == 4:
+				elevation = float32(order.Uint32(raw))
+			case sampleFormat == tiffSampleFormatInt:
+				elevation = float32(int16(order.Uint16(raw)))
+			default:
+				elevation = float32(order.Uint16(raw))
+			}
+
+			if elevation < -1000 || math.IsNaN(float64(elevation)) {
+				elevation = 0
+			}
+			tile.data[row*tile.cols+col] = elevation
+		}
+	}
+
+	return tile, nil
+}
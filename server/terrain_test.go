@@ -0,0 +1,190 @@
+package server
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const terrainTestPath = "testdata/terrain"
+
+func assertElevations(t *testing.T, tile *elevationTile, points [][3]float64) {
+	t.Helper()
+	for _, point := range points {
+		elevation, ok := tile.elevation(point[0], point[1])
+		if !ok {
+			t.Errorf("elevation(%v, %v) is outside the tile", point[0], point[1])
+		} else if math.Abs(elevation-point[2]) > 1e-6 {
+			t.Errorf("elevation(%v, %v) = %v, expected %v", point[0], point[1], elevation, point[2])
+		}
+	}
+}
+
+func TestLoadDTEDTile(t *testing.T) {
+	tile, err := loadDTEDTile(filepath.Join(terrainTestPath, "e032", "n34.dt1"))
+	if err != nil {
+		t.Fatalf("failed to load tile: %v", err)
+	}
+
+	if tile.rows != 5 || tile.cols != 5 || tile.north != 35 || tile.west != 32 || tile.latStep != 0.25 || tile.lngStep != 0.25 {
+		t.Fatalf("unexpected tile bounds %+v", tile)
+	}
+
+	// Posts are 100 per column east and 10 per row north, the south-west post is
+	// null and the one east of it is negative
+	assertElevations(t, tile, [][3]float64{
+		{34, 32, 0},
+		{34, 32.25, -5},
+		{35, 32, 40},
+		{34.5, 32.5, 220},
+		{35, 33, 440},
+		{34.625, 32.125, 75},
+	})
+
+	if _, ok := tile.elevation(35.1, 32.5); ok {
+		t.Errorf("expected a point north of the tile to be outside it")
+	}
+}
+
+func TestLoadGeoTIFFTile(t *testing.T) {
+	tile, err := loadGeoTIFFTile(filepath.Join(terrainTestPath, "N35E033.tif"))
+	if err != nil {
+		t.Fatalf("failed to load tile: %v", err)
+	}
+
+	if tile.rows != 2 || tile.cols != 3 || tile.north != 36 || tile.west != 33 || tile.latStep != 1 || tile.lngStep != 0.5 {
+		t.Fatalf("unexpected tile bounds %+v", tile)
+	}
+
+	// The south-west pixel holds the no data value
+	assertElevations(t, tile, [][3]float64{
+		{36, 33, 10},
+		{36, 34, 30},
+		{35, 33, 0},
+		{35, 34, 60},
+		{35.5, 33.25, 20},
+	})
+}
+
+func TestLoadUnsupportedTerrainFile(t *testing.T) {
+	_, err := loadDTEDTile(filepath.Join(terrainTestPath, "N35E033.tif"))
+	if err != errUnsupportedTerrainFile {
+		t.Errorf("expected errUnsupportedTerrainFile loading a GeoTIFF as DTED, got %v", err)
+	}
+
+	_, err = loadGeoTIFFTile(filepath.Join(terrainTestPath, "e032", "n34.dt1"))
+	if err != errUnsupportedTerrainFile {
+		t.Errorf("expected errUnsupportedTerrainFile loading DTED as a GeoTIFF, got %v", err)
+	}
+}
+
+// Writes a copy of the GeoTIFF fixture with a single short field replaced
+func writeGeoTIFFWithField(t *testing.T, tag uint16, value uint16) string {
+	t.Helper()
+	data, err := ioutil.ReadFile(filepath.Join(terrainTestPath, "N35E033.tif"))
+	if err != nil {
+		t.Fatalf("failed to read fixture: %v", err)
+	}
+
+	ifdOffset := int(binary.LittleEndian.Uint32(data[4:]))
+	entries := int(binary.LittleEndian.Uint16(data[ifdOffset:]))
+	for i := 0; i < entries; i++ {
+		entry := data[ifdOffset+2+i*12:]
+		if binary.LittleEndian.Uint16(entry) == tag {
+			binary.LittleEndian.PutUint16(entry[8:], value)
+			path := filepath.Join(t.TempDir(), "N35E033.tif")
+			if err := ioutil.WriteFile(path, data, 0644); err != nil {
+				t.Fatalf("failed to write tile: %v", err)
+			}
+			return path
+		}
+	}
+	t.Fatalf("fixture has no tag %v", tag)
+	return ""
+}
+
+func TestLoadMalformedGeoTIFFTile(t *testing.T) {
+	cases := []struct {
+		name string
+		tag  uint16
+	}{
+		{"zero rows per strip", tiffTagRowsPerStrip},
+		{"zero width", tiffTagImageWidth},
+		{"zero height", tiffTagImageLength},
+	}
+
+	for _, c := range cases {
+		_, err := loadGeoTIFFTile(writeGeoTIFFWithField(t, c.tag, 0))
+		if err != errUnsupportedTerrainFile {
+			t.Errorf("%s: expected errUnsupportedTerrainFile, got %v", c.name, err)
+		}
+	}
+}
+
+// Waits for the background read of the tile covering a point
+func waitForTile(t *testing.T, terrain *terrainData, lat, lng float64) {
+	t.Helper()
+	key := terrainTileKey(lat, lng)
+	for start := time.Now(); time.Since(start) < time.Second*5; time.Sleep(time.Millisecond) {
+		terrain.Lock()
+		_, ok := terrain.tiles[key]
+		terrain.Unlock()
+		if ok {
+			return
+		}
+	}
+	t.Fatalf("timed out waiting for tile %v", key)
+}
+
+func TestTerrainDataElevation(t *testing.T) {
+	terrain := newTerrainData(terrainTestPath)
+
+	// Tiles are unavailable until they have been read in the background
+	if elevation := terrain.elevation(34.5, 32.5); elevation != 0 {
+		t.Errorf("expected no elevation before the tile is read, got %v", elevation)
+	}
+	waitForTile(t, terrain, 34.5, 32.5)
+	if elevation := terrain.elevation(34.5, 32.5); elevation != 220 {
+		t.Errorf("expected the DTED elevation 220, got %v", elevation)
+	}
+
+	terrain.preload(35.5, 33.25)
+	waitForTile(t, terrain, 35.5, 33.25)
+	if elevation := terrain.elevation(35.5, 33.25); elevation != 20 {
+		t.Errorf("expected the GeoTIFF elevation 20, got %v", elevation)
+	}
+
+	terrain.preload(10, 10)
+	waitForTile(t, terrain, 10, 10)
+	if elevation := terrain.elevation(10.5, 10.5); elevation != 0 {
+		t.Errorf("expected no elevation without a tile, got %v", elevation)
+	}
+}
+
+func TestTerrainDataEvictsLeastRecentlyUsed(t *testing.T) {
+	terrain := newTerrainData(terrainTestPath)
+	terrain.preload(34.5, 32.5)
+	waitForTile(t, terrain, 34.5, 32.5)
+
+	for idx := 0; idx < terrainTileCacheSize; idx++ {
+		// Keep the first tile in use while the cache fills with missing tiles
+		terrain.elevation(34.5, 32.5)
+		terrain.preload(float64(idx)-80, 0)
+		waitForTile(t, terrain, float64(idx)-80, 0)
+	}
+
+	terrain.Lock()
+	defer terrain.Unlock()
+	if len(terrain.tiles) != terrainTileCacheSize {
+		t.Errorf("expected %v cached tiles, got %v", terrainTileCacheSize, len(terrain.tiles))
+	}
+	if _, ok := terrain.tiles[terrainTileKey(34.5, 32.5)]; !ok {
+		t.Errorf("expected the recently used tile to be kept")
+	}
+	if _, ok := terrain.tiles[terrainTileKey(-80, 0)]; ok {
+		t.Errorf("expected the least recently used tile to be evicted")
+	}
+}
@@ -0,0 +1,222 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/alioygur/gores"
+	"github.com/gorilla/websocket"
+)
+
+// Time allowed to write a single message to a websocket client
+const webSocketWriteTimeout = time.Second * 10
+
+// Maximum size (in bytes) of a message sent by a websocket client
+const webSocketReadLimit = 16 * 1024
+
+// Returns whether a websocket may be opened from the page making the request.
+// Browsers attach the web UI session cookie to websocket requests from any site,
+// so only the web UIs own origin and the configured origins are allowed. Clients
+// which aren't browsers don't send an origin.
+func (h *httpServer) checkWebSocketOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	parsed, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	if strings.EqualFold(parsed.Host, r.Host) {
+		return true
+	}
+
+	for _, allowed := range h.config.AllowedOrigins {
+		if strings.EqualFold(origin, allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// A message sent by a websocket client, using the same envelope as events
+type webSocketMessage struct {
+	Event string          `json:"e"`
+	Data  json.RawMessage `json:"d"`
+}
+
+type webSocketSubscribeData struct {
+	// Event names to receive, an empty list receives every event
+	Events []string `json:"events"`
+}
+
+type webSocketAckData struct {
+	Offset int64 `json:"offset"`
+}
+
+type webSocketPongData struct {
+	Data interface{} `json:"data"`
+
+	// Offset of the last radar snapshot acknowledged by the client, or -1
+	AckedOffset int64 `json:"acked_offset"`
+}
+
+type webSocketErrorData struct {
+	Message string `json:"message"`
+}
+
+// Streams events for a given server over a websocket, additionally accepting
+// messages from the client
+func (h *httpServer) streamServerWebSocket(w http.ResponseWriter, r *http.Request) {
+	session := h.ensureSession(w, r)
+	if session == nil {
+		return
+	}
+
+	format, err := parseEventFormat(r.URL.Query().Get("format"))
+	if err != nil {
+		gores.Error(w, 400, "invalid format")
+		return
+	}
+
+	sub, subCloser, initial, ok := h.subscribeClient(w, r, session, format)
+	if !ok {
+		return
+	}
+	defer subCloser()
+
+	messageType := websocket.TextMessage
+	if format == eventFormatMsgPack {
+		messageType = websocket.BinaryMessage
+	}
+
+	// Tracked before upgrading, while the http server still waits on this request,
+	// so shutting down can't miss a stream that is being upgraded
+	h.streams.Add(1)
+	defer h.streams.Done()
+
+	upgrader := websocket.Upgrader{CheckOrigin: h.checkWebSocketOrigin}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("[websocket] failed to upgrade connection: %v", err)
+		return
+	}
+	defer conn.Close()
+	conn.SetReadLimit(webSocketReadLimit)
+
+	closed := make(chan struct{})
+	defer close(closed)
+
+	incoming := make(chan webSocketMessage)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+
+			var msg webSocketMessage
+			err = json.Unmarshal(data, &msg)
+			if err != nil {
+				msg = webSocketMessage{Event: "INVALID"}
+			}
+
+			select {
+			case incoming <- msg:
+			case <-closed:
+				return
+			}
+		}
+	}()
+
+	var filter map[string]bool
+
+	// Clients which reconnect pass this as the streams offset to resume from the
+	// last snapshot they processed
+	var ackedOffset int64 = -1
+
+	write := func(msg sessionEvent) error {
+		conn.SetWriteDeadline(time.Now().Add(webSocketWriteTimeout))
+		return conn.WriteMessage(messageType, msg.encoded)
+	}
+
+	send := func(msg sessionEvent) error {
+		if filter != nil && !filter[msg.name] {
+			return nil
+		}
+		return write(msg)
+	}
+
+	reply := func(event string, data interface{}) error {
+		encoded, err := encodeEvent(format, event, data)
+		if err != nil {
+			return err
+		}
+		return write(encoded)
+	}
+
+	for _, msg := range initial {
+		if err := send(msg); err != nil {
+			return
+		}
+	}
+
+	for {
+		select {
+		case msg, ok := <-sub:
+			if !ok {
+				return
+			}
+
+			if err := send(msg); err != nil {
+				return
+			}
+		case msg := <-incoming:
+			switch msg.Event {
+			case "PING":
+				var data interface{}
+				json.Unmarshal(msg.Data, &data)
+				err = reply("PONG", &webSocketPongData{Data: data, AckedOffset: ackedOffset})
+			case "ACK":
+				var data webSocketAckData
+				if json.Unmarshal(msg.Data, &data) != nil || data.Offset < 0 {
+					err = reply("ERROR", &webSocketErrorData{Message: "invalid ACK data"})
+					break
+				}
+				if data.Offset > ackedOffset {
+					ackedOffset = data.Offset
+				}
+			case "SUBSCRIBE":
+				var data webSocketSubscribeData
+				if json.Unmarshal(msg.Data, &data) != nil {
+					err = reply("ERROR", &webSocketErrorData{Message: "invalid SUBSCRIBE data"})
+					break
+				}
+
+				filter = nil
+				if len(data.Events) > 0 {
+					filter = make(map[string]bool, len(data.Events))
+					for _, event := range data.Events {
+						filter[event] = true
+					}
+				}
+				err = reply("SUBSCRIBED", &data)
+			default:
+				err = reply("ERROR", &webSocketErrorData{Message: "unknown message"})
+			}
+
+			if err != nil {
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}